@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/maxmzkr/protoc_merge/merge"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// cacheVersion is part of every cache key, bump it when the output of a
+// merge changes for the same inputs.
+const cacheVersion = "3"
+
+// cacheEntry is the output of one merge, stored in the cache directory under
+// the hash of its inputs.
+type cacheEntry struct {
+	Content string        `json:"content"`
+	Report  *merge.Report `json:"report"`
+}
+
+// importedFile is a file the inputs can import, as its resolved descriptor.
+type importedFile struct {
+	raw  []byte
+	deps []string
+	// goPackage is the Go import path of the file, "" when it has none
+	goPackage string
+}
+
+// readImports marshals files, the inputs and everything they import, for
+// cache keys.
+func readImports(files []*descriptorpb.FileDescriptorProto) (map[string]*importedFile, error) {
+	out := map[string]*importedFile{}
+	for _, f := range files {
+		raw, err := proto.MarshalOptions{Deterministic: true}.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		out[f.GetName()] = &importedFile{
+			raw:       raw,
+			deps:      f.GetDependency(),
+			goPackage: merge.GoImportPath(f.GetOptions().GetGoPackage()),
+		}
+	}
+	return out, nil
+}
+
+// cacheKey hashes everything the output of name depends on: the
+// parameters, the names of the other outputs, which imports can be pointed
+// at, the Go packages it must not take, the three layers as they were read and every file they import. The
+// parsed files drop positions, which the merged file's comments and layout
+// depend on, and type references are rewritten by what the imports define.
+func (p *params) cacheKey(name string, matchedFile matchedFiles) string {
+	h := sha256.New()
+	write := func(raw []byte) {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(raw))))
+		h.Write(raw)
+	}
+	for _, s := range []string{cacheVersion, p.parameter, name, p.outputsKey, p.goPackagesKey} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	for _, file := range []*inputFile{matchedFile.base, matchedFile.merge, matchedFile.merged} {
+		if file != nil {
+			write(file.raw)
+		}
+		h.Write([]byte{0})
+	}
+	for _, dep := range p.importsOf(matchedFile) {
+		write([]byte(dep))
+		if f, ok := p.imports[dep]; ok {
+			write(f.raw)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// importsOf returns the sorted names of the files the layers import,
+// directly or not.
+func (p *params) importsOf(matchedFile matchedFiles) []string {
+	seen := map[string]bool{}
+	queue := []string{}
+	for _, file := range []*inputFile{matchedFile.base, matchedFile.merge, matchedFile.merged} {
+		if file == nil {
+			continue
+		}
+		if f, ok := p.imports[file.name]; ok {
+			queue = append(queue, f.deps...)
+		}
+	}
+	for len(queue) > 0 {
+		dep := queue[0]
+		queue = queue[1:]
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+		if f, ok := p.imports[dep]; ok {
+			queue = append(queue, f.deps...)
+		}
+	}
+	out := []string{}
+	for dep := range seen {
+		out = append(out, dep)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// readCache returns the entry stored under key, if any. A broken entry is a
+// miss.
+func (p *params) readCache(key string) (*cacheEntry, bool) {
+	data, err := os.ReadFile(filepath.Join(p.cache, key+".json"))
+	if err != nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.Report == nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+// writeCache stores entry under key. The entry is written to a temporary
+// file first so that concurrent runs never read half of one.
+func (p *params) writeCache(key string, entry *cacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.cache, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(p.cache, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(p.cache, key+".json"))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/maxmzkr/protoc_merge/merge"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// locate names the input file of each diagnostic in report. In package mode
+// the types of a merged file come from many files, so only the output is
+// named.
+func (p *params) locate(report *merge.Report, matchedFile matchedFiles) {
+	if p.mode != "file" {
+		return
+	}
+	for _, d := range report.Diagnostics {
+		if file := []*inputFile{matchedFile.base, matchedFile.merge, matchedFile.merged}[d.Layer]; file != nil {
+			d.File = file.name
+		}
+	}
+}
+
+// diagnosticWriter is the one place the diagnostics of a run are written.
+// protoc has no way to take warnings from a plugin, it only passes stderr
+// through, so they go to stderr or, with log_file, to that output file next
+// to the merged files. In check mode nothing is written next to them.
+type diagnosticWriter struct {
+	level  merge.Level
+	format string
+	// file is the output file, "" for stderr
+	file string
+	sink io.Writer
+	log  *strings.Builder
+}
+
+func (p *params) newDiagnosticWriter() *diagnosticWriter {
+	w := &diagnosticWriter{level: p.logLevel, format: p.logFormat, sink: os.Stderr}
+	if p.logFile != "" && !p.check {
+		w.file, w.log = p.logFile, &strings.Builder{}
+		w.sink = w.log
+	}
+	return w
+}
+
+// write writes the diagnostics up to the writer's level, one per line, as
+// text or as JSON.
+func (w *diagnosticWriter) write(diagnostics []*merge.Diagnostic) error {
+	buf := &bytes.Buffer{}
+	for _, d := range diagnostics {
+		if d.Level > w.level {
+			continue
+		}
+		if w.format == "json" {
+			line, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			buf.Write(line)
+		} else {
+			buf.WriteString(d.String())
+		}
+		buf.WriteString("\n")
+	}
+	_, err := w.sink.Write(buf.Bytes())
+	return err
+}
+
+// output returns the log file, nil when the diagnostics went to stderr.
+func (w *diagnosticWriter) output() *pluginpb.CodeGeneratorResponse_File {
+	if w.file == "" {
+		return nil
+	}
+	return &pluginpb.CodeGeneratorResponse_File{
+		Name:    ptr(w.file),
+		Content: ptr(w.log.String()),
+	}
+}
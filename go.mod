@@ -2,4 +2,7 @@ module github.com/maxmzkr/protoc_merge
 
 go 1.21
 
-require google.golang.org/protobuf v1.32.0 // indirect
+require (
+	github.com/bufbuild/protocompile v0.14.1
+	google.golang.org/protobuf v1.34.2
+)
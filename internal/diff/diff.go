@@ -0,0 +1,202 @@
+// Package diff produces unified diffs between two texts.
+package diff
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const context = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type op struct {
+	kind opKind
+	// line indexes into the old and new texts
+	a, b int
+}
+
+// Unified returns a unified diff turning a into b, or an empty string if they
+// are equal.
+func Unified(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	ops := myers(aLines, bLines)
+
+	buf := &strings.Builder{}
+	buf.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", aName, bName))
+
+	for start := 0; start < len(ops); {
+		// find the next change
+		for start < len(ops) && ops[start].kind == opEqual {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+
+		// extend the hunk while changes are within 2*context lines of each other
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != opEqual {
+				end = i + 1
+				continue
+			}
+			if i-end >= 2*context {
+				break
+			}
+		}
+
+		hunkStart := max(start-context, 0)
+		hunkEnd := min(end+context, len(ops))
+		writeHunk(buf, aLines, bLines, ops[hunkStart:hunkEnd])
+		start = hunkEnd
+	}
+
+	return buf.String()
+}
+
+func writeHunk(buf *strings.Builder, aLines, bLines []string, ops []op) {
+	aStart, bStart := ops[0].a, ops[0].b
+	aCount, bCount := 0, 0
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			aCount++
+			bCount++
+		case opDelete:
+			aCount++
+		case opInsert:
+			bCount++
+		}
+	}
+
+	buf.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount)))
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			buf.WriteString(" " + aLines[o.a])
+		case opDelete:
+			buf.WriteString("-" + aLines[o.a])
+		case opInsert:
+			buf.WriteString("+" + bLines[o.b])
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// An empty range names the line before it
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s into lines, keeping the line endings so that a missing
+// newline at the end of the file shows up in the diff.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+// maxEdits bounds the work of myers. Its trace grows with the square of the
+// number of edits, texts further apart than this are diffed as a whole.
+const maxEdits = 1000
+
+// myers computes the shortest edit script between a and b with Myers'
+// algorithm. Past maxEdits it gives up and replaces all of a with b.
+func myers(a, b []string) []op {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxEdits)
+
+	// v holds the furthest x reached on each diagonal k = x - y, at
+	// v[offset+k]. trace[d] is v for diagonals -d..d after d edits
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{}
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := v[offset+k-1] + 1
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+				return backtrack(trace, n, m)
+			}
+		}
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+1]))
+	}
+
+	ops := []op{}
+	for i := range a {
+		ops = append(ops, op{kind: opDelete, a: i, b: 0})
+	}
+	for j := range b {
+		ops = append(ops, op{kind: opInsert, a: n, b: j})
+	}
+	return ops
+}
+
+// backtrack walks the trace of myers back from the end of both texts.
+func backtrack(trace [][]int, n, m int) []op {
+	ops := []op{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		prevX, prevY := 0, 0
+		if d > 0 {
+			// trace[d-1] holds diagonals -(d-1)..d-1
+			prev := func(k int) int { return trace[d-1][k+d-1] }
+			prevK := k - 1
+			if k == -d || (k != d && prev(k-1) < prev(k+1)) {
+				prevK = k + 1
+			}
+			prevX = prev(prevK)
+			prevY = prevX - prevK
+		}
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{kind: opEqual, a: x, b: y})
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, op{kind: opInsert, a: x, b: y})
+		} else {
+			x--
+			ops = append(ops, op{kind: opDelete, a: x, b: y})
+		}
+	}
+	slices.Reverse(ops)
+	return ops
+}
@@ -0,0 +1,131 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"change", "a\nb\nc\n", "a\nx\nc\n", `--- a
++++ b
+@@ -1,3 +1,3 @@
+ a
+-b
++x
+ c
+`},
+		{"insert into empty", "", "a\n", `--- a
++++ b
+@@ -0,0 +1 @@
++a
+`},
+		{"missing newline", "a\n", "a", `--- a
++++ b
+@@ -1 +1 @@
+-a
++a
+\ No newline at end of file
+`},
+		{"separate hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n", `--- a
++++ b
+@@ -1,4 +1,4 @@
+-1
++x
+ 2
+ 3
+ 4
+@@ -7,4 +7,4 @@
+ 7
+ 8
+ 9
+-10
++y
+`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Unified("a", "b", test.a, test.b); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+// apply runs the edit script ops on a and returns the lines of b it builds.
+func apply(t *testing.T, a, b []string, ops []op) []string {
+	t.Helper()
+	out := []string{}
+	i := 0
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			if o.a != i || a[o.a] != b[o.b] {
+				t.Fatalf("bad equal op %+v", o)
+			}
+			out = append(out, a[o.a])
+			i++
+		case opDelete:
+			if o.a != i {
+				t.Fatalf("bad delete op %+v", o)
+			}
+			i++
+		case opInsert:
+			out = append(out, b[o.b])
+		}
+	}
+	if i != len(a) {
+		t.Fatalf("consumed %d of %d lines", i, len(a))
+	}
+	return out
+}
+
+func TestMyers(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		edits int
+	}{
+		{"", "", 0},
+		{"abc", "abc", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"abcabba", "cbabac", 5},
+		{"abgdef", "gh", 6},
+		{"xaxbxc", "abc", 3},
+	} {
+		a, b := strings.Split(test.a, ""), strings.Split(test.b, "")
+		ops := myers(a, b)
+		if got := apply(t, a, b, ops); strings.Join(got, "") != test.b {
+			t.Errorf("%q -> %q: script builds %q", test.a, test.b, strings.Join(got, ""))
+		}
+		edits := 0
+		for _, o := range ops {
+			if o.kind != opEqual {
+				edits++
+			}
+		}
+		if edits != test.edits {
+			t.Errorf("%q -> %q: got %d edits, want %d", test.a, test.b, edits, test.edits)
+		}
+	}
+}
+
+func TestMyersGivesUpPastMaxEdits(t *testing.T) {
+	a, b := []string{}, []string{}
+	for i := 0; i < maxEdits; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	ops := myers(a, b)
+	if got := apply(t, a, b, ops); strings.Join(got, "") != strings.Join(b, "") {
+		t.Error("script doesn't build b")
+	}
+	if len(ops) != 2*maxEdits {
+		t.Errorf("got %d ops, want %d", len(ops), 2*maxEdits)
+	}
+}
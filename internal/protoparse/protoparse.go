@@ -0,0 +1,279 @@
+// Package protoparse compiles .proto files into descriptors without protoc.
+//
+// Parsing and compiling is done by protocompile, whose descriptors, including
+// SourceCodeInfo, match the ones protoc hands to a plugin. This package adds
+// a lenient mode on top for trees whose imports aren't all there.
+package protoparse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/bufbuild/protocompile/ast"
+	"github.com/bufbuild/protocompile/linker"
+	"github.com/bufbuild/protocompile/options"
+	"github.com/bufbuild/protocompile/parser"
+	"github.com/bufbuild/protocompile/reporter"
+	"github.com/bufbuild/protocompile/sourceinfo"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	// Make the well known types importable in lenient mode
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/fieldmaskpb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Parser loads .proto files from ImportPaths, like protoc's -I flag.
+type Parser struct {
+	ImportPaths []string
+	// AllowUnresolved skips imports that can't be found, and keeps type
+	// names that can't be resolved as written. Custom options are left
+	// uninterpreted, with values as written in the source, since they may
+	// be defined in the files that are missing.
+	AllowUnresolved bool
+
+	// files and symbols are the lenient mode's, linked and linkSymbols the
+	// strict mode's
+	files       map[string]*descriptorpb.FileDescriptorProto
+	symbols     map[string]symbolKind
+	linked      map[string]linker.File
+	linkSymbols *linker.Symbols
+	// loading guards against import cycles
+	loading map[string]bool
+}
+
+// Parse compiles the named files and everything they import. It returns the
+// descriptors of the named files in the order given.
+func (p *Parser) Parse(names ...string) ([]*descriptorpb.FileDescriptorProto, error) {
+	if !p.AllowUnresolved {
+		return p.compile(names)
+	}
+
+	if p.files == nil {
+		p.files = map[string]*descriptorpb.FileDescriptorProto{}
+		p.loading = map[string]bool{}
+		p.symbols = map[string]symbolKind{}
+	}
+
+	out := []*descriptorpb.FileDescriptorProto{}
+	for _, name := range names {
+		f, err := p.load(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// compile compiles the files like protoc does, every import must be found.
+func (p *Parser) compile(names []string) ([]*descriptorpb.FileDescriptorProto, error) {
+	if p.linked == nil {
+		p.linked = map[string]linker.File{}
+		p.loading = map[string]bool{}
+		p.linkSymbols = &linker.Symbols{}
+	}
+
+	out := []*descriptorpb.FileDescriptorProto{}
+	for _, name := range names {
+		f, err := p.link(name)
+		if err != nil {
+			return nil, err
+		}
+		// A plugin only knows the extensions linked into it, so the options
+		// defined in .proto files are unknown fields, like they would be in
+		// a CodeGeneratorRequest
+		data, err := proto.Marshal(protodesc.ToFileDescriptorProto(f))
+		if err != nil {
+			return nil, err
+		}
+		request := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(data, request); err != nil {
+			return nil, err
+		}
+		out = append(out, request)
+	}
+	return out, nil
+}
+
+// link parses, links and interprets the options of the named file and its
+// imports. Options that name fields that don't exist are left uninterpreted
+// rather than failing the file, protoc only reports those once it gets to
+// them.
+func (p *Parser) link(name string) (linker.File, error) {
+	if f, ok := p.linked[name]; ok {
+		return f, nil
+	}
+	if p.loading[name] {
+		return nil, fmt.Errorf("%s: import cycle", name)
+	}
+	p.loading[name] = true
+	defer delete(p.loading, name)
+
+	src, err := p.read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		d, err := protoregistry.GlobalFiles.FindFileByPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		f, err := linker.NewFileRecursive(d)
+		if err != nil {
+			return nil, err
+		}
+		p.linked[name] = f
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	handler := reporter.NewHandler(nil)
+	parsed, err := parse(name, src, handler)
+	if err != nil {
+		return nil, err
+	}
+	deps := linker.Files{}
+	for _, dep := range parsed.FileDescriptorProto().GetDependency() {
+		f, err := p.link(dep)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		deps = append(deps, f)
+	}
+
+	linked, err := linker.Link(parsed, deps, p.linkSymbols, handler)
+	if err != nil {
+		return nil, err
+	}
+	index, err := options.InterpretOptionsLenient(linked)
+	if err != nil {
+		return nil, err
+	}
+	parsed.FileDescriptorProto().SourceCodeInfo = sourceinfo.GenerateSourceInfo(parsed.AST(), index)
+	linked.PopulateSourceCodeInfo()
+	p.linked[name] = linked
+	return linked, nil
+}
+
+func (p *Parser) load(name string) (*descriptorpb.FileDescriptorProto, error) {
+	if f, ok := p.files[name]; ok {
+		return f, nil
+	}
+	if p.loading[name] {
+		return nil, fmt.Errorf("%s: import cycle", name)
+	}
+	p.loading[name] = true
+	defer delete(p.loading, name)
+
+	src, err := p.read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Fall back to the files compiled into the binary, this is how
+		// google/protobuf/*.proto are found
+		d, err := protoregistry.GlobalFiles.FindFileByPath(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		f := protodesc.ToFileDescriptorProto(d)
+		addSymbols(p.symbols, f)
+		p.files[name] = f
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := parse(name, src, reporter.NewHandler(nil))
+	if err != nil {
+		return nil, err
+	}
+	f := parsed.FileDescriptorProto()
+	index, err := options.InterpretUnlinkedOptions(parsed)
+	if err != nil {
+		return nil, err
+	}
+	indexUninterpreted(parsed, src, f.ProtoReflect(), index)
+	f.SourceCodeInfo = sourceinfo.GenerateSourceInfo(parsed.AST(), index)
+
+	for _, dep := range f.GetDependency() {
+		_, err := p.load(dep)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	// Names are looked up in all files loaded so far, not only in the ones
+	// f imports
+	addSymbols(p.symbols, f)
+	(&resolver{file: f, symbols: p.symbols}).resolveTypes()
+	p.files[name] = f
+	return f, nil
+}
+
+// parse parses a single file without linking it. Its options are left
+// uninterpreted.
+func parse(name string, src []byte, handler *reporter.Handler) (parser.Result, error) {
+	ast, err := parser.Parse(name, bytes.NewReader(src), handler)
+	if err != nil {
+		return nil, err
+	}
+	return parser.ResultFromAST(ast, true, handler)
+}
+
+// indexUninterpreted adds the options of m and its children that are left
+// uninterpreted to index, so their statements get comments like interpreted
+// ones. Their aggregate values are replaced with the text between the braces
+// in src, the parser respaces them but they can't be reformatted without
+// their message types.
+func indexUninterpreted(parsed parser.Result, src []byte, m protoreflect.Message, index sourceinfo.OptionIndex) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.Message() == nil || fd.IsMap():
+		case fd.Number() == 999 && fd.Message().FullName() == "google.protobuf.UninterpretedOption":
+			for i := 0; i < v.List().Len(); i++ {
+				o := v.List().Get(i).Message().Interface().(*descriptorpb.UninterpretedOption)
+				node, ok := parsed.OptionNode(o).(*ast.OptionNode)
+				if !ok {
+					continue
+				}
+				index[node] = &sourceinfo.OptionSourceInfo{Path: []int32{999, int32(i)}}
+				if o.AggregateValue != nil {
+					info := parsed.AST().NodeInfo(node.Val)
+					o.AggregateValue = proto.String(string(src[info.Start().Offset+1 : info.End().Offset]))
+				}
+			}
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				indexUninterpreted(parsed, src, v.List().Get(i).Message(), index)
+			}
+		default:
+			indexUninterpreted(parsed, src, v.Message(), index)
+		}
+		return true
+	})
+}
+
+func (p *Parser) read(name string) ([]byte, error) {
+	for _, dir := range p.ImportPaths {
+		src, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		return src, err
+	}
+	return nil, fs.ErrNotExist
+}
@@ -0,0 +1,229 @@
+package protoparse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmzkr/protoc_merge/internal/diff"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// writeFiles writes files, named relative to a new directory, and returns
+// the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func parseOne(t *testing.T, p *Parser, name string) *descriptorpb.FileDescriptorProto {
+	t.Helper()
+
+	files, err := p.Parse(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0]
+}
+
+const typesProto = `syntax = "proto2";
+
+package acme.types;
+
+// A shared message
+message Shared {
+  optional string id = 1;
+  extensions 100 to 199;
+}
+
+enum Kind {
+  KIND_UNKNOWN = 0;
+  KIND_OTHER = 1;
+}
+`
+
+const apiProto = `syntax = "proto2";
+
+package acme.api;
+
+import "types.proto";
+import "google/protobuf/timestamp.proto";
+
+// Detached
+
+// Leading
+message Request {
+  // Field comment
+  optional types.Shared shared = 1; // Trailing
+  repeated acme.types.Kind kinds = 2 [packed = true];
+  map<string, Nested> by_name = 3;
+  optional group Result = 4 {
+    optional int32 count = 5;
+  }
+  optional .google.protobuf.Timestamp at = 6 [deprecated = true];
+  oneof choice {
+    Nested nested = 7;
+    int32 number = 8 [default = 5];
+  }
+
+  message Nested {
+    optional Request parent = 1;
+    optional Inner inner = 2;
+    message Inner {
+      optional Nested outer = 1;
+    }
+  }
+
+  extend types.Shared {
+    optional Request request = 100;
+  }
+}
+
+extend acme.types.Shared {
+  repeated Request.Nested nested = 101;
+}
+
+service Service {
+  // Method comment
+  rpc Get(Request) returns (types.Shared);
+}
+`
+
+func TestLenientMatchesStrict(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"types.proto": typesProto,
+		"api.proto":   apiProto,
+	})
+
+	strict := parseOne(t, &Parser{ImportPaths: []string{dir}}, "api.proto")
+	lenient := parseOne(t, &Parser{ImportPaths: []string{dir}, AllowUnresolved: true}, "api.proto")
+
+	if !proto.Equal(strict, lenient) {
+		want := prototext.Format(strict)
+		got := prototext.Format(lenient)
+		t.Errorf("lenient descriptor differs from the strict one:\n%s", diff.Unified("strict", "lenient", want, got))
+	}
+}
+
+func TestStrictRejectsMissingImports(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"api.proto": apiProto})
+
+	if _, err := (&Parser{ImportPaths: []string{dir}}).Parse("api.proto"); err == nil {
+		t.Error("got no error for a missing import")
+	}
+}
+
+func TestLenientKeepsUnresolvedNames(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"api.proto": apiProto})
+	f := parseOne(t, &Parser{ImportPaths: []string{dir}, AllowUnresolved: true}, "api.proto")
+
+	if got := f.GetDependency(); len(got) != 2 {
+		t.Errorf("got imports %v, want both kept", got)
+	}
+	fields := f.GetMessageType()[0].GetField()
+	for i, want := range []struct {
+		typeName string
+		typ      descriptorpb.FieldDescriptorProto_Type
+	}{
+		// Found in no file, so kept as written and of unknown kind
+		{"types.Shared", 0},
+		{"acme.types.Kind", 0},
+		// Found in the file itself
+		{".acme.api.Request.ByNameEntry", descriptorpb.FieldDescriptorProto_TYPE_MESSAGE},
+		{".acme.api.Request.Result", descriptorpb.FieldDescriptorProto_TYPE_GROUP},
+		// Found in the files compiled into the binary
+		{".google.protobuf.Timestamp", descriptorpb.FieldDescriptorProto_TYPE_MESSAGE},
+	} {
+		got := fields[i]
+		// GetType defaults to TYPE_DOUBLE, 0 is no type
+		typ := descriptorpb.FieldDescriptorProto_Type(0)
+		if got.Type != nil {
+			typ = got.GetType()
+		}
+		if got.GetTypeName() != want.typeName || typ != want.typ {
+			t.Errorf("got field %s of type %d %q, want %d %q", got.GetName(), typ, got.GetTypeName(), want.typ, want.typeName)
+		}
+	}
+	if got := f.GetExtension()[0].GetExtendee(); got != "acme.types.Shared" {
+		t.Errorf("got extendee %q, want it as written", got)
+	}
+}
+
+func TestLenientKeepsCustomOptionsAsWritten(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"options.proto": `syntax = "proto3";
+
+package opts;
+
+import "custom.proto";
+
+option go_package = "example.com/opts";
+
+// Leading
+option (custom.aggregate) = {
+  name: "x",
+  nested: { count: 1 }
+}; // Trailing
+
+message M {
+  option (custom.flag) = true;
+}
+`})
+	f := parseOne(t, &Parser{ImportPaths: []string{dir}, AllowUnresolved: true}, "options.proto")
+
+	if got := f.GetOptions().GetGoPackage(); got != "example.com/opts" {
+		t.Errorf("got go_package %q, want it interpreted", got)
+	}
+	uninterpreted := f.GetOptions().GetUninterpretedOption()
+	if len(uninterpreted) != 1 {
+		t.Fatalf("got %d uninterpreted options, want 1", len(uninterpreted))
+	}
+	if got, want := uninterpreted[0].GetAggregateValue(), "\n  name: \"x\",\n  nested: { count: 1 }\n"; got != want {
+		t.Errorf("got aggregate %q, want the text between the braces %q", got, want)
+	}
+	if got := len(f.GetMessageType()[0].GetOptions().GetUninterpretedOption()); got != 1 {
+		t.Errorf("got %d uninterpreted message options, want 1", got)
+	}
+
+	var location *descriptorpb.SourceCodeInfo_Location
+	for _, l := range f.GetSourceCodeInfo().GetLocation() {
+		if len(l.Path) == 3 && l.Path[0] == 8 && l.Path[1] == 999 && l.Path[2] == 0 {
+			location = l
+		}
+	}
+	if location == nil {
+		t.Fatal("got no location for the uninterpreted option")
+	}
+	if location.GetLeadingComments() != " Leading\n" || location.GetTrailingComments() != " Trailing\n" {
+		t.Errorf("got comments %q and %q", location.GetLeadingComments(), location.GetTrailingComments())
+	}
+	// Spans are zero based, the statement is on lines 10 to 13
+	if got := location.GetSpan(); len(got) != 4 || got[0] != 9 || got[2] != 12 {
+		t.Errorf("got span %v", got)
+	}
+}
+
+func TestImportCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.proto": "syntax = \"proto3\";\nimport \"b.proto\";\n",
+		"b.proto": "syntax = \"proto3\";\nimport \"a.proto\";\n",
+	})
+
+	for _, lenient := range []bool{false, true} {
+		if _, err := (&Parser{ImportPaths: []string{dir}, AllowUnresolved: lenient}).Parse("a.proto"); err == nil {
+			t.Errorf("got no error for an import cycle with AllowUnresolved %v", lenient)
+		}
+	}
+}
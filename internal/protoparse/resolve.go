@@ -0,0 +1,186 @@
+package protoparse
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+type symbolKind int
+
+const (
+	symbolPackage symbolKind = iota + 1
+	symbolMessage
+	symbolEnum
+	// symbolOther is a field, enum value, service or method
+	symbolOther
+)
+
+// addSymbols adds every name defined by f to symbols.
+func addSymbols(symbols map[string]symbolKind, f *descriptorpb.FileDescriptorProto) {
+	pkg := f.GetPackage()
+	if pkg != "" {
+		parts := strings.Split(pkg, ".")
+		for i := range parts {
+			name := strings.Join(parts[:i+1], ".")
+			if _, ok := symbols[name]; !ok {
+				symbols[name] = symbolPackage
+			}
+		}
+	}
+
+	for _, m := range f.GetMessageType() {
+		addMessageSymbols(symbols, pkg, m)
+	}
+	for _, e := range f.GetEnumType() {
+		addEnumSymbols(symbols, pkg, e)
+	}
+	for _, x := range f.GetExtension() {
+		symbols[scopedName(pkg, x.GetName())] = symbolOther
+	}
+	for _, s := range f.GetService() {
+		name := scopedName(pkg, s.GetName())
+		symbols[name] = symbolOther
+		for _, m := range s.GetMethod() {
+			symbols[scopedName(name, m.GetName())] = symbolOther
+		}
+	}
+}
+
+func addMessageSymbols(symbols map[string]symbolKind, scope string, m *descriptorpb.DescriptorProto) {
+	name := scopedName(scope, m.GetName())
+	symbols[name] = symbolMessage
+	for _, f := range m.GetField() {
+		symbols[scopedName(name, f.GetName())] = symbolOther
+	}
+	for _, x := range m.GetExtension() {
+		symbols[scopedName(name, x.GetName())] = symbolOther
+	}
+	for _, o := range m.GetOneofDecl() {
+		symbols[scopedName(name, o.GetName())] = symbolOther
+	}
+	for _, nested := range m.GetNestedType() {
+		addMessageSymbols(symbols, name, nested)
+	}
+	for _, e := range m.GetEnumType() {
+		addEnumSymbols(symbols, name, e)
+	}
+}
+
+func addEnumSymbols(symbols map[string]symbolKind, scope string, e *descriptorpb.EnumDescriptorProto) {
+	symbols[scopedName(scope, e.GetName())] = symbolEnum
+	// Enum values are siblings of their enum, not children
+	for _, v := range e.GetValue() {
+		symbols[scopedName(scope, v.GetName())] = symbolOther
+	}
+}
+
+func scopedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// resolve looks name up the way protoc does, starting in scope and moving
+// outwards. It returns the fully qualified name without the leading dot.
+func resolve(symbols map[string]symbolKind, scope, name string) (string, symbolKind, bool) {
+	if strings.HasPrefix(name, ".") {
+		kind, ok := symbols[name[1:]]
+		return name[1:], kind, ok
+	}
+
+	first, _, _ := strings.Cut(name, ".")
+	for {
+		if kind, ok := symbols[scopedName(scope, first)]; ok {
+			full := scopedName(scope, name)
+			if fullKind, ok := symbols[full]; ok {
+				return full, fullKind, true
+			}
+			// The first part shadows anything further out
+			if kind == symbolPackage || kind == symbolMessage {
+				return "", 0, false
+			}
+		}
+		if scope == "" {
+			return "", 0, false
+		}
+		i := strings.LastIndex(scope, ".")
+		if i < 0 {
+			scope = ""
+		} else {
+			scope = scope[:i]
+		}
+	}
+}
+
+// resolver fills in the fully qualified type names and field types of a
+// parsed file, as far as they can be resolved. Names that can't be are kept
+// as written.
+type resolver struct {
+	file    *descriptorpb.FileDescriptorProto
+	symbols map[string]symbolKind
+}
+
+// resolveTypes qualifies every type name in the file.
+func (r *resolver) resolveTypes() {
+	pkg := r.file.GetPackage()
+	for _, m := range r.file.GetMessageType() {
+		r.resolveMessage(pkg, m)
+	}
+	for _, x := range r.file.GetExtension() {
+		r.resolveField(pkg, x)
+	}
+	for _, s := range r.file.GetService() {
+		scope := scopedName(pkg, s.GetName())
+		for _, m := range s.GetMethod() {
+			m.InputType = proto.String(r.resolveType(scope, m.GetInputType(), symbolMessage))
+			m.OutputType = proto.String(r.resolveType(scope, m.GetOutputType(), symbolMessage))
+		}
+	}
+}
+
+func (r *resolver) resolveMessage(scope string, m *descriptorpb.DescriptorProto) {
+	name := scopedName(scope, m.GetName())
+	for _, f := range m.GetField() {
+		r.resolveField(name, f)
+	}
+	for _, x := range m.GetExtension() {
+		r.resolveField(name, x)
+	}
+	for _, nested := range m.GetNestedType() {
+		r.resolveMessage(name, nested)
+	}
+}
+
+func (r *resolver) resolveField(scope string, f *descriptorpb.FieldDescriptorProto) {
+	if f.Extendee != nil {
+		f.Extendee = proto.String(r.resolveType(scope, f.GetExtendee(), symbolMessage))
+	}
+
+	if f.TypeName == nil {
+		return
+	}
+	full, kind, ok := resolve(r.symbols, scope, f.GetTypeName())
+	if !ok || (kind != symbolMessage && kind != symbolEnum) {
+		return
+	}
+	f.TypeName = proto.String("." + full)
+	switch {
+	case f.GetType() == descriptorpb.FieldDescriptorProto_TYPE_GROUP:
+		// The parser already knows groups
+	case kind == symbolMessage:
+		f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+	default:
+		f.Type = descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum()
+	}
+}
+
+func (r *resolver) resolveType(scope, name string, want symbolKind) string {
+	full, kind, ok := resolve(r.symbols, scope, name)
+	if !ok || kind != want {
+		return name
+	}
+	return "." + full
+}
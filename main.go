@@ -2,15 +2,25 @@ package main
 
 import (
 	"cmp"
-	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 
+	"github.com/maxmzkr/protoc_merge/internal/diff"
+	"github.com/maxmzkr/protoc_merge/internal/protoparse"
 	"github.com/maxmzkr/protoc_merge/merge"
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/types/descriptorpb"
 	"google.golang.org/protobuf/types/pluginpb"
 )
 
@@ -31,27 +41,83 @@ type mergeSpec struct {
 	packages  []string
 }
 
-type matchedFiles struct {
-	base   *descriptorpb.FileDescriptorProto
-	merge  *descriptorpb.FileDescriptorProto
-	merged *descriptorpb.FileDescriptorProto
-}
+// params are the options passed with --merge_opt, or -opt in source mode.
+type params struct {
+	prefixes []string
+	packages []string
+	// packageRules are the package=from=>to rules, tried before the plain
+	// packages
+	packageRules []merge.PackageRule
+	// mappings are the map= rules followed by the one the prefixes make
+	mappings []*merge.Mapping
+	paths    map[string]bool
+	reports  map[string]bool
+	check    bool
+	// root is the directory check mode reads the committed merged files
+	// from, the working directory by default
+	root          string
+	commentPolicy merge.CommentPolicy
+	banner        *template.Template
+	anchor        merge.Anchor
+	// optionTemplates are the templates given for language options, e.g.
+	// go_package={{.OutputDir}}
+	optionTemplates map[string]*template.Template
+	// mode is "file" to merge files pairwise or "package" to merge whole
+	// packages, see merge.MergeSpec.Regroup
+	mode      string
+	placement merge.Placement
+	// places are the place=Type=>file rules of package mode
+	places map[string]string
+	// cache is the directory outputs are cached in by the hash of their
+	// inputs, "" for none
+	cache string
+	// jobs is how many files are merged at once
+	jobs int
+	// parameter is the whole parameter string, it's part of cache keys
+	parameter string
+	// deleted is what happens to merged files that base and the overlay no
+	// longer have, "tombstone" or "fail"
+	deleted string
+	// logLevel is the least important level of diagnostics that is
+	// written, logFormat "text" or "json". The diagnostics are written to
+	// stderr, or to the output file logFile when it is set.
+	logLevel  merge.Level
+	logFormat string
+	logFile   string
 
-func main() {
-	data, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		os.Exit(1)
-	}
+	// outputs are the merged files of the current run, outputsKey their
+	// sorted names for cache keys
+	outputs    map[string]bool
+	outputsKey string
+	// imports are the inputs and every file they import, by name
+	imports map[string]*importedFile
+	// goPackages are the Go import paths of the inputs that aren't previous
+	// outputs, goPackagesKey the sorted paths for cache keys
+	goPackages    map[string]string
+	goPackagesKey string
+}
 
-	req := &pluginpb.CodeGeneratorRequest{}
-	if err := proto.Unmarshal(data, req); err != nil {
-		os.Exit(1)
+func parseParams(parameter string) (*params, error) {
+	p := &params{
+		paths:           map[string]bool{},
+		reports:         map[string]bool{},
+		optionTemplates: map[string]*template.Template{},
+		commentPolicy:   merge.CommentsConcat,
+		banner:          merge.DefaultBanner,
+		anchor:          merge.AnchorEnd,
+		deleted:         "tombstone",
+		mode:            "file",
+		placement:       merge.PlaceOverlay,
+		places:          map[string]string{},
+		jobs:            runtime.GOMAXPROCS(0),
+		parameter:       parameter,
+		logLevel:        merge.LevelWarn,
+		logFormat:       "text",
+		root:            ".",
 	}
 
-	prefixes := []string{}
-	packages := []string{}
-	paths := map[string]bool{}
-	for _, param := range strings.Split(req.GetParameter(), ",") {
+	var err error
+	for _, param := range strings.Split(parameter, ",") {
 		var value string
 		if i := strings.Index(param, "="); i >= 0 {
 			value = param[i+1:]
@@ -60,89 +126,478 @@ func main() {
 		switch param {
 		case "":
 		case "prefix":
-			prefixes = append(prefixes, value)
+			p.prefixes = append(p.prefixes, value)
+		case "map":
+			m, err := merge.ParseMapping(value)
+			if err != nil {
+				return nil, err
+			}
+			p.mappings = append(p.mappings, m)
 		case "package":
-			packages = append(packages, value)
+			if !strings.Contains(value, "=>") {
+				p.packages = append(p.packages, value)
+				continue
+			}
+			rule, err := merge.ParsePackageRule(value)
+			if err != nil {
+				return nil, err
+			}
+			p.packageRules = append(p.packageRules, rule)
 		case "paths":
-			paths[value] = true
+			p.paths[value] = true
+		case "comments":
+			p.commentPolicy, err = merge.ParseCommentPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+		case "banner":
+			if value == "none" {
+				p.banner = nil
+				continue
+			}
+			// Parameters can't contain newlines, so allow them to be escaped
+			p.banner, err = merge.ParseBanner(strings.ReplaceAll(value, `\n`, "\n"))
+			if err != nil {
+				return nil, err
+			}
+		case "anchor":
+			p.anchor, err = merge.ParseAnchor(value)
+			if err != nil {
+				return nil, err
+			}
+		case "deleted":
+			switch value {
+			case "tombstone", "fail":
+				p.deleted = value
+			default:
+				return nil, fmt.Errorf("unknown deleted policy %q", value)
+			}
+		case "mode":
+			switch value {
+			case "file", "package":
+				p.mode = value
+			default:
+				return nil, fmt.Errorf("unknown mode %q", value)
+			}
+		case "placement":
+			p.placement, err = merge.ParsePlacement(value)
+			if err != nil {
+				return nil, err
+			}
+		case "place":
+			typ, file, ok := strings.Cut(value, "=>")
+			if !ok {
+				return nil, fmt.Errorf("place %q isn't Type=>file", value)
+			}
+			p.places[strings.TrimPrefix(typ, ".")] = file
+		case "cache":
+			p.cache = value
+		case "jobs":
+			p.jobs, err = strconv.Atoi(value)
+			if err != nil || p.jobs < 1 {
+				return nil, fmt.Errorf("jobs must be a positive number, got %q", value)
+			}
+		case "log":
+			p.logLevel, err = merge.ParseLevel(value)
+			if err != nil {
+				return nil, err
+			}
+		case "log_format":
+			switch value {
+			case "text", "json":
+				p.logFormat = value
+			default:
+				return nil, fmt.Errorf("unknown log format %q", value)
+			}
+		case "log_file":
+			p.logFile = value
+		case "check":
+			p.check = value == "" || value == "true"
+		case "root":
+			p.root = value
+		case "report":
+			switch value {
+			case "json", "markdown":
+				p.reports[value] = true
+			default:
+				return nil, fmt.Errorf("unknown report format %q", value)
+			}
 		default:
-			os.Exit(1)
+			if !slices.Contains(merge.LanguageOptions, param) {
+				return nil, fmt.Errorf("unknown parameter %q", param)
+			}
+			p.optionTemplates[param], err = merge.ParseOptionTemplate(param, value)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	if len(prefixes) != 3 {
-		os.Exit(1)
+	// The prefixes can be left out when map= rules name every file
+	switch {
+	case len(p.prefixes) == 3:
+		m, err := merge.PrefixMapping(p.prefixes[0], p.prefixes[1], p.prefixes[2])
+		if err != nil {
+			return nil, err
+		}
+		p.mappings = append(p.mappings, m)
+	case len(p.prefixes) != 0 || len(p.mappings) == 0:
+		return nil, fmt.Errorf("expected 3 prefixes, got %d", len(p.prefixes))
 	}
 
-	if len(packages) != 2 {
-		os.Exit(1)
+	// The packages can be left out when rules name every package, base's
+	// is only needed when base spans several packages
+	if len(p.packages) != 2 && len(p.packages) != 3 && (len(p.packages) != 0 || len(p.packageRules) == 0) {
+		return nil, fmt.Errorf("expected 2 or 3 packages, got %d", len(p.packages))
 	}
 
-	resp := &pluginpb.CodeGeneratorResponse{
-		SupportedFeatures: proto.Uint64(uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)),
+	return p, nil
+}
+
+// inputFile is a file under one of the prefixes, named like protoc names it.
+type inputFile struct {
+	name string
+	file *merge.File
+	// raw is the file as it was read, the source or the descriptor protoc
+	// sent with its SourceCodeInfo. Unlike file it has every position
+	raw []byte
+}
+
+type matchedFiles struct {
+	base   *inputFile
+	merge  *inputFile
+	merged *inputFile
+	// committed is the merged file as it is on disk. In package mode merged
+	// is regrouped and can differ from it
+	committed *inputFile
+}
+
+// match returns the first mapping name is in, its layer and its key.
+func (p *params) match(name string) (*merge.Mapping, merge.Layer, string, bool) {
+	for _, m := range p.mappings {
+		if layer, key, ok := m.Match(name); ok {
+			return m, layer, key, true
+		}
 	}
+	return nil, 0, "", false
+}
+
+// spec returns the merge spec for the output file name.
+func (p *params) spec(name string) *merge.MergeSpec {
+	spec := &merge.MergeSpec{
+		Packages: p.packageRules,
+		Mappings: p.mappings,
+		Outputs:  p.outputs,
 
-	filesToGenerate := make(map[string]bool)
-	for _, name := range req.GetFileToGenerate() {
-		filesToGenerate[name] = true
+		CommentPolicy: p.commentPolicy,
+		Banner:        p.banner,
+		Anchor:        p.anchor,
+
+		OptionTemplates: p.optionTemplates,
+		OutputFile:      name,
+		GoPackages:      p.goPackages,
+
+		Placement: p.placement,
+		Places:    p.places,
+
+		LogLevel: p.logLevel,
 	}
+	switch len(p.packages) {
+	case 2:
+		spec.MergePackage = p.packages[0]
+		spec.MergedPackage = p.packages[1]
+	case 3:
+		spec.BasePackage = p.packages[0]
+		spec.MergePackage = p.packages[1]
+		spec.MergedPackage = p.packages[2]
+	}
+	return spec
+}
 
-	matchedMap := map[string]matchedFiles{}
-	for _, file := range req.GetProtoFile() {
-		for i, prefix := range prefixes {
-			if strings.HasPrefix(file.GetName(), prefix) {
-				suffix := file.GetName()[len(prefix):]
-				matchedFile := matchedMap[suffix]
-				switch i {
-				case 0:
-					matchedFile.base = file
-				case 1:
-					matchedFile.merge = file
-				case 2:
-					matchedFile.merged = file
-				}
-				matchedMap[suffix] = matchedFile
+// readGoPackages sets the Go packages merged files must not take: those of
+// every file that isn't a previous output.
+func (p *params) readGoPackages() {
+	names := []string{}
+	for name := range p.imports {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	p.goPackages = map[string]string{}
+	paths := []string{}
+	for _, name := range names {
+		goPackage := p.imports[name].goPackage
+		if _, layer, _, ok := p.match(name); goPackage == "" || (ok && layer == merge.LayerMerged) {
+			continue
+		}
+		if _, ok := p.goPackages[goPackage]; !ok {
+			p.goPackages[goPackage] = name
+			paths = append(paths, goPackage)
+		}
+	}
+	slices.Sort(paths)
+	p.goPackagesKey = strings.Join(paths, "\x00")
+}
+
+// regroup moves the types of the matched files to the files they are
+// written to in package mode.
+func (p *params) regroup(matchedMap map[string]matchedFiles) {
+	layers := [3]map[string]*merge.File{{}, {}, {}}
+	for name, matchedFile := range matchedMap {
+		for i, file := range []*inputFile{matchedFile.base, matchedFile.merge, matchedFile.merged} {
+			if file != nil {
+				layers[i][name] = file.file
 			}
 		}
 	}
 
-	for _, matchedFile := range matchedMap {
-		if matchedFile.base == nil {
-			continue
+	base, overlay, merged := p.spec("").Regroup(layers[0], layers[1], layers[2])
+
+	file := func(files map[string]*merge.File, name string) *inputFile {
+		if f, ok := files[name]; ok {
+			return &inputFile{name: name, file: f}
 		}
+		return nil
+	}
+	// Types can be placed in files only the other layer has
+	for _, files := range []map[string]*merge.File{base, overlay} {
+		for name := range files {
+			if _, ok := matchedMap[name]; !ok {
+				matchedMap[name] = matchedFiles{}
+			}
+		}
+	}
+	for name, matchedFile := range matchedMap {
+		matchedFile.base = file(base, name)
+		matchedFile.merge = file(overlay, name)
+		matchedFile.merged = file(merged, name)
+		matchedMap[name] = matchedFile
+	}
+}
+
+// result is the output of one file. It's either the merged file or, when it
+// came from the cache, its content.
+type result struct {
+	file    *merge.File
+	content string
+	report  *merge.Report
+	// skip is set for files that have nothing to write
+	skip bool
+	err  error
+}
+
+// mergeFile merges the layers of the output file name.
+func (p *params) mergeFile(name string, matchedFile matchedFiles) *result {
+	// Package mode fixes the imports of the merged files afterwards, so only
+	// pairwise merges are cached
+	cached := p.cache != "" && p.mode == "file"
+	key := ""
+	if cached {
+		key = p.cacheKey(name, matchedFile)
+		if entry, ok := p.readCache(key); ok {
+			return &result{content: entry.Content, report: entry.Report}
+		}
+	}
+
+	mergeSpec := p.spec(name)
+
+	mergedF := &merge.File{}
+	if matchedFile.merged != nil {
+		mergedF = matchedFile.merged.file
+	}
 
-		if matchedFile.merge == nil {
+	var outF *merge.File
+	var report *merge.Report
+	var err error
+	switch {
+	case matchedFile.base == nil && matchedFile.merge == nil:
+		if matchedFile.merged == nil {
+			// Its types moved to other files
+			return &result{skip: true}
+		}
+		if p.deleted == "fail" {
+			return &result{err: fmt.Errorf("removed from base and the overlay")}
+		}
+		// The numbers the file held stay reserved
+		outF, report, err = mergeSpec.Tombstone(mergedF)
+	case matchedFile.merge == nil:
+		// Files the overlay doesn't touch are carried over so that
+		// imports of them from the merged files resolve
+		outF, report, err = mergeSpec.PassThrough(matchedFile.base.file, merge.OriginBase, mergedF)
+	case matchedFile.base == nil:
+		outF, report, err = mergeSpec.PassThrough(matchedFile.merge.file, merge.OriginOverlay, mergedF)
+	default:
+		outF, report, err = mergeSpec.MergeFile(matchedFile.base.file, matchedFile.merge.file, mergedF)
+	}
+	if err != nil {
+		return &result{err: err}
+	}
+	p.locate(report, matchedFile)
+
+	if !cached {
+		return &result{file: outF, report: report}
+	}
+	content := merge.Serialize(outF)
+	// A cache that can't be written only costs time
+	_ = p.writeCache(key, &cacheEntry{Content: content, Report: report})
+	return &result{content: content, report: report}
+}
+
+// run merges the files and returns the files to write. In check mode it
+// returns the diffs of the stale files instead. The diagnostics are returned
+// in name order for a diagnosticWriter.
+func run(p *params, files []*inputFile) ([]*pluginpb.CodeGeneratorResponse_File, []string, []*merge.Diagnostic, error) {
+	out := []*pluginpb.CodeGeneratorResponse_File{}
+	stale := []string{}
+
+	matchedMap := map[string]matchedFiles{}
+	for _, file := range files {
+		m, layer, key, ok := p.match(file.name)
+		if !ok {
 			continue
 		}
+		// Files are paired by the output file they map to
+		name := m.Name(merge.LayerMerged, key)
+		matchedFile := matchedMap[name]
+		switch layer {
+		case merge.LayerBase:
+			matchedFile.base = file
+		case merge.LayerOverlay:
+			matchedFile.merge = file
+		case merge.LayerMerged:
+			matchedFile.merged = file
+			matchedFile.committed = file
+		}
+		matchedMap[name] = matchedFile
+	}
 
-		mergeSpec := merge.MergeSpec{
-			MergePackage:  packages[0],
-			MergedPackage: packages[1],
+	if p.mode == "package" {
+		p.regroup(matchedMap)
+	}
 
-			MergePrefix:  prefixes[1],
-			MergedPrefix: prefixes[2],
+	names := []string{}
+	p.outputs = map[string]bool{}
+	for name, matchedFile := range matchedMap {
+		names = append(names, name)
+		// Files whose types all moved away aren't written
+		if matchedFile.base != nil || matchedFile.merge != nil || matchedFile.merged != nil {
+			p.outputs[name] = true
 		}
+	}
+	slices.Sort(names)
+	p.outputsKey = strings.Join(names, "\x00")
+	p.readGoPackages()
 
-		j, err := json.MarshalIndent(req, "", "  ")
-		if err != nil {
-			os.Exit(1)
+	// Files are merged concurrently, results are kept in name order so the
+	// output doesn't depend on scheduling
+	results := make([]*result, len(names))
+	sem := make(chan struct{}, p.jobs)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		i, name := i, name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = p.mergeFile(name, matchedMap[name])
+		}()
+	}
+	wg.Wait()
+
+	outFiles := map[string]*merge.File{}
+	for i, name := range names {
+		if results[i].err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", name, results[i].err)
 		}
-		log.Println(string(j))
+		if results[i].file != nil {
+			outFiles[name] = results[i].file
+		}
+	}
 
-		baseF := merge.ParseFile(matchedFile.base)
-		mergeF := merge.ParseFile(matchedFile.merge)
-		mergedF := merge.ParseFile(matchedFile.merged)
+	if p.mode == "package" {
+		merge.FixImports(outFiles)
+	}
 
-		outF := mergeSpec.MergeFile(baseF, mergeF, mergedF)
-		file := &pluginpb.CodeGeneratorResponse_File{
-			// We can't use merged file name because it might not exist yet
-			Name:    ptr(strings.Replace(matchedFile.merge.GetName(), prefixes[1], prefixes[2], 1)),
-			Content: ptr(merge.Serialize(outF)),
+	diagnostics := []*merge.Diagnostic{}
+	for i, name := range names {
+		r := results[i]
+		if r.skip {
+			continue
+		}
+		for _, d := range r.report.Diagnostics {
+			d.Output = name
+			diagnostics = append(diagnostics, d)
+		}
+		content := r.content
+		if r.file != nil {
+			content = merge.Serialize(r.file)
+		}
+
+		if p.check {
+			// Compare against the bytes on disk, anything the model
+			// doesn't keep, like hand edits, is stale too
+			committed := ""
+			if c := matchedMap[name].committed; c != nil {
+				data, err := os.ReadFile(filepath.Join(p.root, filepath.FromSlash(c.name)))
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				committed = string(data)
+			}
+			if d := diff.Unified(name, name+" (regenerated)", committed, content); d != "" {
+				stale = append(stale, d)
+			}
+			continue
+		}
+
+		out = append(out, &pluginpb.CodeGeneratorResponse_File{
+			Name:    ptr(name),
+			Content: ptr(content),
+		})
+
+		report := r.report
+		report.File = name
+		reportName := strings.TrimSuffix(name, ".proto") + ".merge-report"
+		if p.reports["json"] {
+			content, err := report.JSON()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			out = append(out, &pluginpb.CodeGeneratorResponse_File{
+				Name:    ptr(reportName + ".json"),
+				Content: ptr(string(content)),
+			})
+		}
+		if p.reports["markdown"] {
+			out = append(out, &pluginpb.CodeGeneratorResponse_File{
+				Name:    ptr(reportName + ".md"),
+				Content: ptr(report.Markdown()),
+			})
 		}
-		resp.File = append(resp.File, file)
 	}
 
-	data, err = proto.Marshal(resp)
+	slices.Sort(stale)
+	return out, stale, diagnostics, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		mainSource()
+		return
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	req := &pluginpb.CodeGeneratorRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		os.Exit(1)
+	}
+
+	data, err = proto.Marshal(generate(req))
 	if err != nil {
 		os.Exit(1)
 	}
@@ -151,3 +606,178 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// generate answers a request from protoc. Errors are returned in the
+// response, protoc prints them and fails.
+func generate(req *pluginpb.CodeGeneratorRequest) *pluginpb.CodeGeneratorResponse {
+	resp := &pluginpb.CodeGeneratorResponse{
+		SupportedFeatures: proto.Uint64(uint64(pluginpb.CodeGeneratorResponse_FEATURE_PROTO3_OPTIONAL)),
+	}
+	fail := func(err error) *pluginpb.CodeGeneratorResponse {
+		resp.Error = ptr(err.Error())
+		return resp
+	}
+
+	p, err := parseParams(req.GetParameter())
+	if err != nil {
+		return fail(err)
+	}
+
+	// All files are parsed together so that custom options can be named
+	parsed, err := merge.ParseFiles(req.GetProtoFile())
+	if err != nil {
+		return fail(err)
+	}
+	// protoc sends every file the inputs import
+	p.imports, err = readImports(req.GetProtoFile())
+	if err != nil {
+		return fail(err)
+	}
+	files := []*inputFile{}
+	for i, file := range req.GetProtoFile() {
+		if _, _, _, ok := p.match(file.GetName()); !ok {
+			continue
+		}
+		files = append(files, &inputFile{name: file.GetName(), file: parsed[i], raw: p.imports[file.GetName()].raw})
+	}
+
+	// Conflicts between the layers are reported through protoc, along with
+	// anything else that goes wrong after them
+	errs := []error{}
+	out, stale, diagnostics, err := run(p, files)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	resp.File = out
+	w := p.newDiagnosticWriter()
+	if err := w.write(diagnostics); err != nil {
+		errs = append(errs, err)
+	}
+	if file := w.output(); file != nil {
+		resp.File = append(resp.File, file)
+	}
+
+	if len(stale) > 0 {
+		errs = append(errs, fmt.Errorf("merged files are stale, regenerate them:\n%s", strings.Join(stale, "")))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fail(err)
+	}
+	return resp
+}
+
+// parseSource parses the named files under root like ParseSource does, and
+// returns them along with every file they import that could be found.
+func parseSource(root string, names []string) ([]*inputFile, map[string]*importedFile, error) {
+	parser := &protoparse.Parser{ImportPaths: []string{root}, AllowUnresolved: true}
+	descriptors, err := parser.Parse(names...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := []*inputFile{}
+	for i, name := range names {
+		raw, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, &inputFile{name: name, file: merge.ParseFile(descriptors[i]), raw: raw})
+	}
+
+	// The parser has loaded the imports already, parsing them again only
+	// looks them up
+	all := slices.Clone(descriptors)
+	seen := map[string]bool{}
+	for i := 0; i < len(all); i++ {
+		for _, dep := range all[i].GetDependency() {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			d, err := parser.Parse(dep)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			all = append(all, d[0])
+		}
+	}
+	imports, err := readImports(all)
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, imports, nil
+}
+
+// mainSource merges a tree of .proto files directly, without protoc.
+func mainSource() {
+	flags := flag.NewFlagSet("protoc-gen-merge", flag.ExitOnError)
+	root := flags.String("root", ".", "directory the prefixes and imports are relative to")
+	outDir := flags.String("out", "", "directory to write the merged files to (default -root)")
+	opt := flags.String("opt", "", "the same options protoc takes with --merge_opt")
+	flags.Parse(os.Args[1:])
+
+	if *outDir == "" {
+		*outDir = *root
+	}
+
+	p, err := parseParams(*opt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.root = *root
+
+	names := []string{}
+	err = filepath.WalkDir(*root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".proto" {
+			return err
+		}
+		name, err := filepath.Rel(*root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if _, _, _, ok := p.match(name); ok {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files, imports, err := parseSource(*root, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.imports = imports
+
+	out, stale, diagnostics, err := run(p, files)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := p.newDiagnosticWriter()
+	if err := w.write(diagnostics); err != nil {
+		log.Fatal(err)
+	}
+	if file := w.output(); file != nil {
+		out = append(out, file)
+	}
+
+	if len(stale) > 0 {
+		fmt.Fprintf(os.Stderr, "merged files are stale, regenerate them:\n%s", strings.Join(stale, ""))
+		os.Exit(1)
+	}
+
+	for _, file := range out {
+		path := filepath.Join(*outDir, filepath.FromSlash(file.GetName()))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file.GetContent()), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
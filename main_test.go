@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maxmzkr/protoc_merge/merge"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+)
+
+// syntheticTree returns files files under each of the example prefixes,
+// each with messages messages of 20 fields.
+func syntheticTree(files, messages int) []*inputFile {
+	out := []*inputFile{}
+	for _, layer := range []struct{ prefix, pkg string }{
+		{"example/base", "example.base"},
+		{"example/merge", "example.merge"},
+	} {
+		for i := 0; i < files; i++ {
+			f := &merge.File{
+				Syntax:  &merge.Syntax{Name: "proto3"},
+				Package: &merge.Package{Name: layer.pkg},
+			}
+			for j := 0; j < messages; j++ {
+				m := &merge.Message{Name: fmt.Sprintf("F%dM%d", i, j)}
+				for k := 0; k < 20; k++ {
+					m.Fields = append(m.Fields, &merge.Field{Name: fmt.Sprintf("f%d", k), Type: "string", Number: int32(k + 1)})
+				}
+				f.Messages = append(f.Messages, m)
+			}
+			out = append(out, &inputFile{name: fmt.Sprintf("%s/f%d.proto", layer.prefix, i), file: f, raw: []byte(merge.Serialize(f))})
+		}
+	}
+	return out
+}
+
+func BenchmarkRun(b *testing.B) {
+	const opt = "prefix=example/base,prefix=example/merge,prefix=example/merged,package=example.merge,package=example.merged"
+	files := syntheticTree(2000, 5)
+
+	for _, test := range []struct {
+		name string
+		opt  string
+	}{
+		{"serial", opt + ",jobs=1"},
+		{"parallel", opt},
+		{"package", opt + ",mode=package"},
+		{"cached", opt + ",cache=" + b.TempDir()},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			p, err := parseParams(test.opt)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// The first run fills the cache
+			if _, _, _, err := run(p, files); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := run(p, files); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunIsDeterministic(t *testing.T) {
+	files := syntheticTree(50, 3)
+	outputs := []string{}
+	for _, jobs := range []string{"1", "8"} {
+		p, err := parseParams("prefix=example/base,prefix=example/merge,prefix=example/merged,package=example.merge,package=example.merged,report=json,jobs=" + jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _, _, err := run(p, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := ""
+		for _, f := range out {
+			text += f.GetName() + "\n" + f.GetContent()
+		}
+		outputs = append(outputs, text)
+	}
+	if outputs[0] != outputs[1] {
+		t.Error("merging concurrently changed the output")
+	}
+}
+
+func TestCheckDiffsCommittedBytes(t *testing.T) {
+	const opt = "prefix=example/base,prefix=example/merge,prefix=example/merged,package=example.merge,package=example.merged"
+	files := syntheticTree(1, 1)
+
+	p, err := parseParams(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, _, err := run(p, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, content := out[0].GetName(), out[0].GetContent()
+
+	root := t.TempDir()
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		content string
+		stale   bool
+	}{
+		{"up to date", content, false},
+		// The model drops the comment, so only the bytes show the edit
+		{"hand edit", content + "// edited\n", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(test.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := merge.ParseSource([]string{root}, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := parseParams(opt + ",check,root=" + root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			committed := &inputFile{name: name, file: parsed[0]}
+			_, stale, _, err := run(p, append(slices.Clone(files), committed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(stale) > 0; got != test.stale {
+				t.Errorf("got stale %v, want %v: %v", got, test.stale, stale)
+			}
+		})
+	}
+}
+
+func TestCacheKeySeesEveryByte(t *testing.T) {
+	const opt = "prefix=example/base,prefix=example/merge,prefix=example/merged,package=example.merge,package=example.merged"
+	p, err := parseParams(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	name := "example/base/test.proto"
+	for _, dir := range []string{"example/base", "common"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const base = "syntax = \"proto3\";\nimport \"common/c.proto\";\nmessage M {\n  c.Thing thing = 1;\n}\n"
+	const common = "syntax = \"proto3\";\npackage c;\nmessage Thing {}\n"
+	keys := map[string]bool{}
+	for _, test := range []struct {
+		name         string
+		base, common string
+	}{
+		{"first", base, common},
+		// The model drops the comment, the key must not
+		{"comment edit", base + "// edited\n", common},
+		// c.Thing no longer resolves, which changes how it's rewritten
+		{"import edit", base + "// edited\n", "syntax = \"proto3\";\npackage c;\n"},
+	} {
+		for path, content := range map[string]string{name: test.base, "common/c.proto": test.common} {
+			if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(path)), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files, imports, err := parseSource(root, []string{name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.imports = imports
+		key := p.cacheKey("example/merged/test.proto", matchedFiles{base: files[0]})
+		if keys[key] {
+			t.Errorf("%s: kept the cache key", test.name)
+		}
+		keys[key] = true
+	}
+}
+
+func TestDiagnosticsHaveOneSink(t *testing.T) {
+	diagnostics := []*merge.Diagnostic{
+		{Level: merge.LevelWarn, Path: "M.a", Message: "type changed from int32 to string"},
+		{Level: merge.LevelInfo, Path: "M.b", Message: "allocated number 2"},
+	}
+	p, err := parseParams("prefix=a,prefix=b,prefix=c,package=b,package=c,log_file=merge.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := p.newDiagnosticWriter()
+	if w.sink == io.Writer(os.Stderr) {
+		t.Fatal("diagnostics go to stderr with log_file")
+	}
+	if err := w.write(diagnostics); err != nil {
+		t.Fatal(err)
+	}
+	// Only warnings are written by default
+	file := w.output()
+	if file.GetName() != "merge.log" || file.GetContent() != "warn: M.a: type changed from int32 to string\n" {
+		t.Errorf("got log file %s with %q", file.GetName(), file.GetContent())
+	}
+
+	// Nothing is written next to the merged files in check mode
+	p.check = true
+	if w := p.newDiagnosticWriter(); w.output() != nil {
+		t.Error("got a log file in check mode")
+	}
+}
+
+func TestGenerateReportsErrors(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		parameter string
+		files     []*descriptorpb.FileDescriptorProto
+		want      string
+	}{
+		{"bad parameter", "prefix=a,prefix=b,prefix=c,package=b", nil, "expected 2 or 3 packages, got 1"},
+		{"conflicting files", "prefix=a,prefix=b,prefix=c,package=b,package=c", []*descriptorpb.FileDescriptorProto{
+			{Name: ptr("a/x.proto"), Package: ptr("a"), MessageType: []*descriptorpb.DescriptorProto{{Name: ptr("M")}}},
+			{Name: ptr("a/y.proto"), Package: ptr("a"), MessageType: []*descriptorpb.DescriptorProto{{Name: ptr("M")}}},
+		}, "a.M"},
+	} {
+		resp := generate(&pluginpb.CodeGeneratorRequest{Parameter: ptr(test.parameter), ProtoFile: test.files})
+		if !strings.Contains(resp.GetError(), test.want) {
+			t.Errorf("%s: got error %q, want it to mention %q", test.name, resp.GetError(), test.want)
+		}
+	}
+}
+
+func TestRunChecksEveryGoPackage(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		// a.proto's package is the one b.proto's merged file gets
+		"base/a.proto":     "syntax = \"proto3\";\npackage base;\noption go_package = \"example.com/merged/sub\";\n",
+		"base/sub/b.proto": "syntax = \"proto3\";\npackage base;\nmessage B {}\n",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, imports, err := parseSource(root, []string{"base/a.proto", "base/sub/b.proto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := parseParams("prefix=base,prefix=merge,prefix=merged,package=merge,package=merged,go_package=example.com/{{.OutputDir}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.imports = imports
+	_, _, _, err = run(p, files)
+	if err == nil || !strings.Contains(err.Error(), `go_package "example.com/merged/sub" is the same as base/a.proto's`) {
+		t.Errorf("got error %v, want a go_package clash with base/a.proto", err)
+	}
+}
@@ -0,0 +1,78 @@
+package merge
+
+import (
+	"fmt"
+	"testing"
+)
+
+// syntheticFile returns a file of pkg with messages messages of fields
+// fields each, every other one using the message before it.
+func syntheticFile(pkg string, messages, fields int) *File {
+	f := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: pkg},
+		Options: []*Option{{Name: "java_package", Value: fmt.Sprintf("%q", "com."+pkg)}},
+	}
+	for i := 0; i < messages; i++ {
+		m := &Message{Name: fmt.Sprintf("M%d", i)}
+		for j := 0; j < fields; j++ {
+			field := &Field{Name: fmt.Sprintf("f%d", j), Type: "int32", Number: int32(j + 1)}
+			if i > 0 && j%2 == 1 {
+				field.Type = fmt.Sprintf(".%s.M%d", pkg, i-1)
+			}
+			m.Fields = append(m.Fields, field)
+		}
+		f.Messages = append(f.Messages, m)
+	}
+	f.Enums = append(f.Enums, &Enum{
+		Name:   "E",
+		Values: []*EnumValue{{Name: "E_UNSPECIFIED"}, {Name: "E_A", Number: 1}},
+	})
+	return f
+}
+
+func BenchmarkMergeFile(b *testing.B) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged", Banner: DefaultBanner}
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("messages=%d", size), func(b *testing.B) {
+			base := syntheticFile("base", size, 20)
+			merge := syntheticFile("merge", size, 25)
+			merged, _, err := spec.MergeFile(base, merge, &File{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := spec.MergeFile(base, merge, merged); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	f := syntheticFile("merged", 1000, 20)
+	for i := 0; i < b.N; i++ {
+		Serialize(f)
+	}
+}
+
+func BenchmarkRegroup(b *testing.B) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+	for _, size := range []int{100, 2000} {
+		b.Run(fmt.Sprintf("files=%d", size), func(b *testing.B) {
+			base, merge, merged := map[string]*File{}, map[string]*File{}, map[string]*File{}
+			for i := 0; i < size; i++ {
+				name := fmt.Sprintf("merged/f%d.proto", i)
+				base[name] = syntheticFile("base", 10, 10)
+				merge[name] = syntheticFile("merge", 10, 10)
+				merged[name] = syntheticFile("merged", 10, 10)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				spec.Regroup(base, merge, merged)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package merge
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// CommentPolicy decides how the comments of an element that exists in both
+// layers are combined.
+type CommentPolicy string
+
+const (
+	// CommentsConcat keeps the detached comments of both layers and prefers
+	// the overlay's leading and trailing comments. This is the default.
+	CommentsConcat CommentPolicy = "concat"
+	// CommentsDedupe is CommentsConcat with repeated comments dropped.
+	CommentsDedupe CommentPolicy = "dedupe"
+	// CommentsOverlay only keeps the overlay's comments, unless it has none.
+	CommentsOverlay CommentPolicy = "overlay"
+	// CommentsBase only keeps the base's comments, unless it has none.
+	CommentsBase CommentPolicy = "base"
+	// CommentsAnnotate is CommentsDedupe with every comment tagged with the
+	// layer it came from.
+	CommentsAnnotate CommentPolicy = "annotate"
+)
+
+func ParseCommentPolicy(s string) (CommentPolicy, error) {
+	switch p := CommentPolicy(s); p {
+	case CommentsConcat, CommentsDedupe, CommentsOverlay, CommentsBase, CommentsAnnotate:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown comment policy %q", s)
+}
+
+// BannerData is passed to the banner template.
+type BannerData struct {
+	// Kind is the group of elements the banner introduces, e.g. "Fields".
+	Kind string
+	// Layer is "base" or "merge".
+	Layer string
+}
+
+var DefaultBanner = template.Must(ParseBanner("//////\n {{.Kind}} from {{.Layer}}\n//////\n"))
+
+var (
+	bannerKinds  = []string{"Options", "Dependencies", "Enums", "Values", "Messages", "Fields", "Oneofs", "Extensions"}
+	bannerLayers = []string{"base", "merge"}
+)
+
+// ParseBanner parses a banner template. Like comments in descriptors, the
+// rendered banner has no comment markers and every line ends in a newline.
+func ParseBanner(text string) (*template.Template, error) {
+	t, err := template.New("banner").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&strings.Builder{}, BannerData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderBanner(t *template.Template, kind, layer string) string {
+	buf := &strings.Builder{}
+	// The template was checked by ParseBanner
+	_ = t.Execute(buf, BannerData{Kind: kind, Layer: layer})
+	return buf.String()
+}
+
+// knownBanners returns every banner this spec or the default could have
+// written, so that they can be dropped when a previous output is merged again.
+func (s *merger) knownBanners() map[string]bool {
+	out := map[string]bool{}
+	for _, t := range []*template.Template{DefaultBanner, s.Banner} {
+		if t == nil {
+			continue
+		}
+		for _, kind := range bannerKinds {
+			for _, layer := range bannerLayers {
+				out[normalizeComment(renderBanner(t, kind, layer))] = true
+			}
+		}
+	}
+	return out
+}
+
+func (s *merger) addBanner(c *Comments, kind, layer string) {
+	if s.Banner == nil {
+		return
+	}
+	c.LeadingDetachedComments = append([]string{renderBanner(s.Banner, kind, layer)}, c.LeadingDetachedComments...)
+}
+
+func (s *merger) mergeComments(base, merge Comments) Comments {
+	base = s.cleanComments(base)
+	merge = s.cleanComments(merge)
+
+	switch s.CommentPolicy {
+	case CommentsBase:
+		if base.empty() {
+			return merge
+		}
+		return base
+	case CommentsOverlay:
+		if merge.empty() {
+			return base
+		}
+		return merge
+	case CommentsAnnotate:
+		base = annotateComments(base, "base")
+		merge = annotateComments(merge, "overlay")
+	}
+
+	out := Comments{
+		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
+		LeadingComments:         base.LeadingComments,
+		TrailingComments:        base.TrailingComments,
+	}
+	if len(merge.LeadingComments) > 0 {
+		out.LeadingComments = merge.LeadingComments
+	}
+	if len(merge.TrailingComments) > 0 {
+		out.TrailingComments = merge.TrailingComments
+	}
+
+	// Annotated comments are deduplicated too, otherwise feeding an
+	// annotated output back in would repeat every comment.
+	if s.CommentPolicy == CommentsDedupe || s.CommentPolicy == CommentsAnnotate {
+		seen := map[string]bool{
+			normalizeComment(stripAnnotations(out.LeadingComments)):  true,
+			normalizeComment(stripAnnotations(out.TrailingComments)): true,
+		}
+		out.LeadingDetachedComments = slices.DeleteFunc(out.LeadingDetachedComments, func(c string) bool {
+			n := normalizeComment(stripAnnotations(c))
+			if seen[n] {
+				return true
+			}
+			seen[n] = true
+			return false
+		})
+	}
+
+	return out
+}
+
+// cleanComments drops what a previous merge added so that merging an output
+// again doesn't stack banners and tags.
+func (s *merger) cleanComments(c Comments) Comments {
+	out := Comments{
+		LeadingComments:  stripAnnotations(c.LeadingComments),
+		TrailingComments: stripAnnotations(c.TrailingComments),
+	}
+	for _, d := range c.LeadingDetachedComments {
+		if s.banners[normalizeComment(d)] {
+			continue
+		}
+		if d = stripAnnotations(d); d == "" {
+			continue
+		}
+		out.LeadingDetachedComments = append(out.LeadingDetachedComments, d)
+	}
+	return out
+}
+
+func (c Comments) empty() bool {
+	return len(c.LeadingDetachedComments) == 0 && c.LeadingComments == "" && c.TrailingComments == ""
+}
+
+const annotationPrefix = "@from "
+
+func annotateComments(c Comments, layer string) Comments {
+	out := Comments{
+		LeadingComments:  annotate(c.LeadingComments, layer),
+		TrailingComments: annotate(c.TrailingComments, layer),
+	}
+	for _, d := range c.LeadingDetachedComments {
+		out.LeadingDetachedComments = append(out.LeadingDetachedComments, annotate(d, layer))
+	}
+	return out
+}
+
+func annotate(comment, layer string) string {
+	if comment == "" {
+		return ""
+	}
+	return comment + " " + annotationPrefix + layer + "\n"
+}
+
+// stripAnnotations drops the @from tags, and the @merge directives which
+// only mean something in the overlay.
+func stripAnnotations(comment string) string {
+	lines := strings.SplitAfter(comment, "\n")
+	lines = slices.DeleteFunc(lines, func(l string) bool {
+		l = strings.TrimSpace(l)
+		return strings.HasPrefix(l, annotationPrefix) || strings.HasPrefix(l, directivePrefix)
+	})
+	out := strings.Join(lines, "")
+	if strings.TrimSpace(out) == "" {
+		return ""
+	}
+	return out
+}
+
+// normalizeComment makes comments that only differ in whitespace compare
+// equal.
+func normalizeComment(comment string) string {
+	lines := strings.Split(strings.TrimSpace(comment), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,117 @@
+package merge
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is how much a diagnostic matters. Levels are ordered from the most
+// to the least important, so the zero Level only keeps warnings.
+type Level int
+
+const (
+	LevelWarn Level = iota
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"warn", "info", "debug"}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// Diagnostic is something a merge noticed that isn't an error, like a field
+// whose type changed or a newly allocated number.
+type Diagnostic struct {
+	Level Level `json:"level"`
+	// Output is the merged file
+	Output string `json:"output,omitempty"`
+	// Layer is the layer Position is in, File the name of its file there.
+	// The merge only knows the layer, File is filled in by the caller and
+	// is empty when the position can't be tied to a file.
+	Layer Layer  `json:"-"`
+	File  string `json:"file,omitempty"`
+	Position
+	// Path is the dotted name of the element relative to the file's
+	// package, empty for the file itself
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// String formats d like protoc formats its own warnings, e.g.
+// "example/merge/test.proto:12:3: warn: Test.id: type changed".
+func (d *Diagnostic) String() string {
+	buf := &strings.Builder{}
+	switch {
+	case d.File != "" && d.Line > 0:
+		fmt.Fprintf(buf, "%s:%d:%d: ", d.File, d.Line, d.Column)
+	case d.File != "":
+		fmt.Fprintf(buf, "%s: ", d.File)
+	case d.Output != "":
+		fmt.Fprintf(buf, "%s: ", d.Output)
+	}
+	fmt.Fprintf(buf, "%s: ", d.Level)
+	if d.Path != "" {
+		fmt.Fprintf(buf, "%s: ", d.Path)
+	}
+	buf.WriteString(d.Message)
+	return buf.String()
+}
+
+// logf records a diagnostic about the element at path, at is where it is
+// declared in layer. Diagnostics above the spec's LogLevel are dropped.
+func (s *merger) logf(level Level, layer Layer, at Position, path string, format string, args ...any) {
+	if level > s.LogLevel {
+		return
+	}
+	s.report.Diagnostics = append(s.report.Diagnostics, &Diagnostic{
+		Level:    level,
+		Layer:    layer,
+		Position: at,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// declared returns where an element of both layers is declared, the
+// overlay's position when it has one.
+func declared(base, merge Position) (Layer, Position) {
+	if merge.Line > 0 {
+		return LayerOverlay, merge
+	}
+	return LayerBase, base
+}
+
+// describeOneof describes where a field is declared for a diagnostic.
+func describeOneof(oneof string) string {
+	if oneof == "" {
+		return "a plain field"
+	}
+	return "oneof " + oneof
+}
@@ -0,0 +1,84 @@
+package merge
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmzkr/protoc_merge/internal/diff"
+	"github.com/maxmzkr/protoc_merge/internal/protoparse"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files in testdata/golden")
+
+// parseExample compiles dir/test.proto, dir is relative to the merge
+// package. An empty dir is a layer that doesn't exist.
+func parseExample(t *testing.T, dir string) *File {
+	t.Helper()
+
+	if dir == "" {
+		return &File{}
+	}
+
+	p := &protoparse.Parser{ImportPaths: []string{dir, filepath.Join("..", "example", "options")}}
+	descriptors, err := p.Parse("options.proto", "test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseFiles(descriptors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[1]
+}
+
+func TestGolden(t *testing.T) {
+	for _, test := range []struct {
+		step                string
+		base, merge, merged string
+	}{
+		{"step1", "../example/step1/base", "../example/step1/merge", ""},
+		// example/step2/merged was written by an older version whose option
+		// printer wrote "option  = ;", which doesn't compile, so the step1
+		// output is the previous output instead
+		{"step2", "../example/step2/base", "../example/step2/merge", "testdata/golden/step1"},
+		{"step3", "../example/step2/base", "../example/step2/merge", "../example/step3/merged"},
+	} {
+		test := test
+		t.Run(test.step, func(t *testing.T) {
+			spec := &MergeSpec{
+				MergePackage:    "merge",
+				MergedPackage:   "merged",
+				Banner:          DefaultBanner,
+				OptionTemplates: exampleTemplates,
+				OutputFile:      exampleOutput,
+			}
+			base := parseExample(t, filepath.FromSlash(test.base))
+			merge := parseExample(t, filepath.FromSlash(test.merge))
+			merged := parseExample(t, filepath.FromSlash(test.merged))
+
+			out, _ := mustMerge(t, spec, base, merge, merged)
+			got := Serialize(out)
+
+			golden := filepath.Join("testdata", "golden", test.step, "test.proto")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run go test ./merge -update to create it", err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s, run go test ./merge -update if this is expected:\n%s", golden, diff.Unified(golden, "got", string(want), got))
+			}
+		})
+	}
+}
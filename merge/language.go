@@ -0,0 +1,125 @@
+package merge
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// LanguageOptions are the file options that name the package of the
+// generated code. They can be rewritten with templates, since the merged
+// file's code must not land in the package of base's.
+var LanguageOptions = []string{
+	"go_package",
+	"java_package",
+	"java_outer_classname",
+	"csharp_namespace",
+	"objc_class_prefix",
+	"php_namespace",
+	"php_metadata_namespace",
+	"ruby_package",
+	"swift_prefix",
+}
+
+// OptionData is passed to the option templates.
+type OptionData struct {
+	// OutputFile is the name of the merged file, OutputDir its directory
+	OutputFile string
+	OutputDir  string
+	// Package is the merged file's package, PackageLast its last segment
+	Package     string
+	PackageLast string
+	// Value is the option's value after layering, unquoted, or "" when
+	// neither layer sets it
+	Value string
+}
+
+// ParseOptionTemplate parses the template of a language option, e.g.
+// "{{.OutputDir}};{{.PackageLast}}pb" for go_package.
+func ParseOptionTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&strings.Builder{}, OptionData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// templateOptions sets the options that have a template to its output. An
+// option neither layer sets is added.
+func (s *merger) templateOptions(out *File, options []*Option) []*Option {
+	data := OptionData{
+		OutputFile:  s.OutputFile,
+		OutputDir:   path.Dir(s.OutputFile),
+		Package:     out.Package.Name,
+		PackageLast: out.Package.Name[strings.LastIndex(out.Package.Name, ".")+1:],
+	}
+
+	for _, name := range LanguageOptions {
+		t, ok := s.OptionTemplates[name]
+		if !ok {
+			continue
+		}
+
+		var option *Option
+		for _, o := range options {
+			if o.Name == name {
+				option = o
+			}
+		}
+		if option == nil {
+			option = &Option{Name: name}
+			options = append(options, option)
+		}
+
+		data.Value, _ = strconv.Unquote(option.Value)
+		buf := &strings.Builder{}
+		// The template was checked by ParseOptionTemplate
+		_ = t.Execute(buf, data)
+		option.Value = quote([]byte(buf.String()))
+	}
+
+	return options
+}
+
+// GoImportPath returns the import path of a go_package value, without an
+// explicit package name.
+func GoImportPath(goPackage string) string {
+	importPath, _, _ := strings.Cut(goPackage, ";")
+	return importPath
+}
+
+// checkGoPackage reports an error if the merged file's Go package is the
+// Go package of one of the layers or of any other input file, the two
+// couldn't be compiled together.
+func (s *merger) checkGoPackage(out, base, merge *File) {
+	goPackage := func(f *File) string {
+		for _, o := range f.Options {
+			if o.Name == "go_package" {
+				value, _ := strconv.Unquote(o.Value)
+				return GoImportPath(value)
+			}
+		}
+		return ""
+	}
+
+	outPackage := goPackage(out)
+	if outPackage == "" {
+		return
+	}
+	for _, layer := range []struct {
+		name string
+		file *File
+	}{{"base", base}, {"the overlay", merge}} {
+		if goPackage(layer.file) == outPackage {
+			s.errorf("go_package %q is the same as %s's, set a go_package template", outPackage, layer.name)
+			return
+		}
+	}
+	if name, ok := s.GoPackages[outPackage]; ok {
+		s.errorf("go_package %q is the same as %s's, set a go_package template", outPackage, name)
+	}
+}
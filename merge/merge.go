@@ -1,17 +1,92 @@
 package merge
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
-	"log"
+	"regexp"
+	"slices"
 	"strings"
+	"text/template"
 )
 
 type MergeSpec struct {
 	MergePackage  string
 	MergedPackage string
+	// BasePackage is rewritten to MergedPackage, along with the packages
+	// under it, when base is carried along. Without it each base file's own
+	// package is, which only holds up when base is a single package.
+	BasePackage string
+	// Packages are tried in order before MergePackage, for trees that span
+	// several packages.
+	Packages []PackageRule
 
 	MergePrefix  string
 	MergedPrefix string
+	// BasePrefix is where the base files are. When it is set base is carried
+	// into the output tree too: imports of base files and references to the
+	// base package are rewritten to the merged ones, like the overlay's are.
+	BasePrefix string
+	// Mappings pair files of the layers that aren't at the same path under
+	// the prefixes. Imports are rewritten by them before the prefixes.
+	Mappings []*Mapping
+	// Outputs are the merged files of the run. Imports that no mapping
+	// names are only rewritten by the package rules when that makes them
+	// one of these, files outside the merge stay where they are.
+	Outputs map[string]bool
+
+	// CommentPolicy decides how comments from both layers are combined.
+	CommentPolicy CommentPolicy
+	// Banner is rendered as a detached comment in front of each group of
+	// elements, e.g. "Fields from base". Banners are left out when it is nil.
+	Banner *template.Template
+	// Anchor decides where the overlay's own elements are placed, AnchorEnd
+	// when it is empty.
+	Anchor Anchor
+	// OptionTemplates rewrite language options of the merged file, keyed by
+	// option name, see LanguageOptions. OutputFile is the name of the merged
+	// file, the templates can use it.
+	OptionTemplates map[string]*template.Template
+	OutputFile      string
+	// GoPackages are the Go import paths of the input files, each with the
+	// name of a file that has it. The merged file's go_package can't be any
+	// of them, its layers' are always checked.
+	GoPackages map[string]string
+	// Placement and Places decide which file each type is written to in a
+	// package merge, see Regroup. Places is keyed by the merged type's
+	// fully qualified name, without the leading dot.
+	Placement Placement
+	Places    map[string]string
+	// LogLevel is the least important level of diagnostics kept in the
+	// report, LevelWarn when it is zero.
+	LogLevel Level
+}
+
+// merger carries the state of a single MergeFile call.
+type merger struct {
+	*MergeSpec
+
+	basePackage  string
+	mergePackage string
+
+	// passThrough is set when one of the layers is empty and the other is
+	// carried over as it is, see PassThrough
+	passThrough bool
+	// syntax is the output's syntax
+	syntax string
+
+	// banners are the rendered banners to drop from the inputs
+	banners map[string]bool
+	// mappings are the explicit mappings followed by the one the prefixes
+	// make
+	mappings []*Mapping
+	// packages are the explicit package rules followed by MergePackage's
+	// and, when base is carried along, base's
+	packages []PackageRule
+
+	errs []error
+
+	report *Report
 }
 
 type EnumHaver interface {
@@ -26,187 +101,213 @@ type FieldHaver interface {
 	GetFields() []*Field
 }
 
-type numberer struct {
-	reserved map[string]int32
-	used     map[int32]bool
-	next     int32
+type ExtensionHaver interface {
+	GetExtensions() []*Extension
 }
 
-func newNumberer(start int32) *numberer {
-	return &numberer{
-		reserved: make(map[string]int32),
-		used:     make(map[int32]bool),
-		next:     start - 1,
-	}
+// MergeFile merges the overlay file merge onto base. merged is the previous
+// output and is used to keep numbers stable across runs. The returned report
+// describes where every element of the output came from. Conflicts between
+// the layers are returned as errors, along with the output.
+func (s *MergeSpec) MergeFile(base *File, merge *File, merged *File) (*File, *Report, error) {
+	m := s.newMerger(base.Package.Name, merge.Package.Name)
+	out := m.mergeFile(base, merge, merged)
+	return out, m.report, errors.Join(m.errs...)
 }
 
-func (n *numberer) use(name string, number int32) {
-	n.reserved[name] = number
-	n.used[number] = true
+// PassThrough carries a file that only one layer has into the output, with
+// its package, imports and types rewritten like a merged file's. origin is
+// the layer f is from, OriginBase or OriginOverlay.
+func (s *MergeSpec) PassThrough(f *File, origin Origin, merged *File) (*File, *Report, error) {
+	empty := &File{
+		Syntax:  &Syntax{Name: f.Syntax.Name},
+		Package: &Package{Name: f.Package.Name},
+	}
+	base, merge := f, empty
+	if origin == OriginOverlay {
+		base, merge = empty, f
+	}
+	m := s.newMerger(base.Package.Name, merge.Package.Name)
+	m.passThrough = true
+	layer, only := LayerBase, "base"
+	if origin == OriginOverlay {
+		layer, only = LayerOverlay, "the overlay"
+	}
+	m.logf(LevelDebug, layer, Position{}, "", "only %s has the file, carrying it over", only)
+	out := m.mergeFile(base, merge, merged)
+	return out, m.report, errors.Join(m.errs...)
 }
 
-func (n *numberer) number(name string) int32 {
-	if number, ok := n.reserved[name]; ok {
-		return number
-	}
-
-	for {
-		n.next += 1
-		if _, ok := n.used[n.next]; !ok {
-			break
-		}
-	}
+func (s *MergeSpec) newMerger(basePackage, mergePackage string) *merger {
+	m := &merger{
+		MergeSpec:    s,
+		basePackage:  basePackage,
+		mergePackage: mergePackage,
+		report:       &Report{},
+	}
+	m.banners = m.knownBanners()
+	m.mappings = m.buildMappings()
+	m.packages = m.buildPackages()
+	return m
+}
 
-	n.reserved[name] = n.next
-	return n.next
+func (s *merger) errorf(format string, args ...any) {
+	s.errs = append(s.errs, fmt.Errorf(format, args...))
 }
 
-func (s *MergeSpec) MergeFile(base *File, merge *File, merged *File) *File {
+func (s *merger) mergeFile(base *File, merge *File, merged *File) *File {
 	out := &File{}
 
-	out.Syntax = &Syntax{
-		LeadingDetachedComments: append(
-			append(
-				[]string{},
-				base.Syntax.LeadingDetachedComments...,
-			),
-			merge.Syntax.LeadingDetachedComments...,
-		),
-		LeadingComments:  base.Syntax.LeadingComments,
-		TrailingComments: base.Syntax.TrailingComments,
-		Name:             "proto3",
+	// The output is written in the syntax of its inputs, their fields'
+	// labels and defaults don't carry over to another one
+	if base.Syntax.Name != merge.Syntax.Name {
+		s.errorf("the overlay's syntax %q is not base's %q", merge.Syntax.Name, base.Syntax.Name)
 	}
-	if len(merge.Syntax.LeadingComments) > 0 {
-		out.Syntax.LeadingComments = merge.Syntax.LeadingComments
-	}
-	if len(merge.Syntax.TrailingComments) > 0 {
-		out.Syntax.TrailingComments = merge.Syntax.TrailingComments
+	out.Syntax = &Syntax{
+		Comments: s.mergeComments(base.Syntax.Comments, merge.Syntax.Comments),
+		Name:     base.Syntax.Name,
 	}
+	s.syntax = out.Syntax.Name
 
 	out.Package = &Package{
-		LeadingDetachedComments: append(append([]string{}, base.Package.LeadingDetachedComments...), merge.Package.LeadingDetachedComments...),
-		LeadingComments:         base.Package.LeadingComments,
-		TrailingComments:        base.Package.TrailingComments,
-		Name:                    strings.Replace(merge.Package.Name, s.MergePackage, s.MergedPackage, 1),
-	}
-	if len(merge.Package.LeadingComments) > 0 {
-		out.Package.LeadingComments = merge.Package.LeadingComments
-	}
-	if len(merge.Package.TrailingComments) > 0 {
-		out.Package.TrailingComments = merge.Package.TrailingComments
+		Comments: s.mergeComments(base.Package.Comments, merge.Package.Comments),
+		Name:     s.rewritePackage(merge.Package.Name),
 	}
 
-	outDeps := map[string]*Dependency{}
+	out.Options = s.templateOptions(out, s.mergeOptions("", base.Options, merge.Options))
+	s.checkGoPackage(out, base, merge)
 
+	// Dependencies are matched by where they point in the output
+	outDeps := map[string]bool{}
 	mergeDeps := map[string]*Dependency{}
 	for _, d := range merge.Dependencies {
-		mergeDeps[d.Name] = d
+		mergeDeps[s.rewriteImport(d.Name)] = d
 	}
 
-	out.Options = s.mergeOptions(base, merge)
-
 	first := true
 	for _, based := range base.Dependencies {
-		outD := based
-		if mergeD, ok := mergeDeps[based.Name]; ok {
-			outD.LeadingDetachedComments = append(append([]string{}, based.LeadingDetachedComments...), mergeD.LeadingDetachedComments...)
-			if len(mergeD.LeadingComments) > 0 {
-				outD.LeadingComments = mergeD.LeadingComments
-			}
-			if len(mergeD.TrailingComments) > 0 {
-				outD.TrailingComments = mergeD.TrailingComments
-			}
+		name := s.rewriteImport(based.Name)
+		mergeD, ok := mergeDeps[name]
+		if !ok {
+			mergeD = &Dependency{}
+		}
+
+		outD := &Dependency{
+			Comments: s.mergeComments(based.Comments, mergeD.Comments),
+			Name:     name,
 		}
 
 		if first {
 			first = false
-			outD.LeadingDetachedComments = append([]string{"//////\n Dependencies from base\n//////\n"}, outD.LeadingDetachedComments...)
+			s.addBanner(&outD.Comments, "Dependencies", "base")
 		}
 
 		out.Dependencies = append(out.Dependencies, outD)
-		outDeps[outD.Name] = based
+		outDeps[name] = true
 	}
 	first = true
 	for _, mergeD := range merge.Dependencies {
-		if _, ok := outDeps[mergeD.Name]; ok {
+		name := s.rewriteImport(mergeD.Name)
+		if outDeps[name] {
 			continue
 		}
-		outD := mergeD
+		outD := &Dependency{
+			Comments: s.mergeComments(Comments{}, mergeD.Comments),
+			Name:     name,
+		}
 
 		if first {
 			first = false
-			mergeD.LeadingDetachedComments = append([]string{"//////\n Dependencies from merge\n//////\n"}, mergeD.LeadingDetachedComments...)
-		}
-
-		if strings.HasPrefix(outD.Name, s.MergePrefix) {
-			outD.Name = strings.Replace(mergeD.Name, s.MergePackage, s.MergedPackage, 1)
+			s.addBanner(&outD.Comments, "Dependencies", "merge")
 		}
 
 		out.Dependencies = append(out.Dependencies, outD)
+		outDeps[name] = true
 	}
 
-	out.Enums = s.mergeEnums(base, merge, merged)
-	out.Messages = s.mergeMessages(base, merge, merged)
+	out.Enums = s.mergeEnums("", base, merge, merged)
+	out.Messages = s.mergeMessages("", base, merge, merged)
+	out.Extensions = s.mergeExtensions("", base, merge, merged)
+
+	s.order(s.fileElements(out), s.fileElements(base), s.fileElements(merge))
 
 	return out
 }
 
-func (s *MergeSpec) mergeOptions(base, merge *File) []*FileOption {
-	out := []*FileOption{}
-	outMap := map[string]*FileOption{}
+// mergeOptions merges options by name, the overlay's value wins.
+func (s *merger) mergeOptions(scope string, base, merge []*Option) []*Option {
+	out := []*Option{}
+	outMap := map[string]*Option{}
 
-	mergeMap := map[string]*FileOption{}
-	for _, o := range merge.Options {
-		mergeMap[o.Name] = o
+	// Options are matched by their rewritten names, custom options of the
+	// overlay's package are the same options as the merged package's
+	mergeMap := map[string]*Option{}
+	for _, o := range merge {
+		mergeMap[s.rewriteOption(o.Name)] = o
 	}
 
 	first := true
-	for _, baseO := range base.Options {
-		log.Printf("base \"%s\"", baseO.Name)
-		mergeO, ok := mergeMap[baseO.Name]
+	for _, baseO := range base {
+		name := s.rewriteOption(baseO.Name)
+		mergeO, ok := mergeMap[name]
+		origin := OriginBoth
 		if !ok {
-			mergeO = &FileOption{
-				Name: baseO.Name,
+			origin = OriginBase
+			mergeO = &Option{
+				Name:  baseO.Name,
+				Value: baseO.Value,
 			}
+			s.logf(LevelDebug, LayerBase, baseO.Position, scopedName(scope, name), "option set by base to %s", baseO.Value)
+		} else {
+			s.logf(LevelDebug, LayerOverlay, mergeO.Position, scopedName(scope, name), "option set by both layers, the overlay's %s wins over %s", mergeO.Value, baseO.Value)
 		}
 
-		outO := &FileOption{
-			LeadingDetachedComments: append(append([]string{}, baseO.LeadingDetachedComments...), mergeO.LeadingDetachedComments...),
-			LeadingComments:         baseO.LeadingComments,
-			TrailingComments:        baseO.TrailingComments,
-			Name:                    baseO.Name,
-			Value:                   mergeO.Value,
+		outO := &Option{
+			Comments: s.mergeComments(baseO.Comments, mergeO.Comments),
+			Name:     name,
+			Value:    s.rewriteOption(mergeO.Value),
 		}
 
 		if first {
 			first = false
-			outO.LeadingDetachedComments = append([]string{"//////\n Options from base\n//////\n"}, outO.LeadingDetachedComments...)
+			s.addBanner(&outO.Comments, "Options", "base")
 		}
 
+		s.report.add(&ReportEntry{
+			Kind:   KindOption,
+			Path:   scopedName(scope, outO.Name),
+			Origin: origin,
+		})
+
 		out = append(out, outO)
 		outMap[outO.Name] = outO
 	}
 
 	first = true
-	for _, mergeO := range merge.Options {
-		log.Printf("merge \"%s\"", mergeO.Name)
-		if _, ok := outMap[mergeO.Name]; ok {
+	for _, mergeO := range merge {
+		name := s.rewriteOption(mergeO.Name)
+		if _, ok := outMap[name]; ok {
 			continue
 		}
+		s.logf(LevelDebug, LayerOverlay, mergeO.Position, scopedName(scope, name), "option set by the overlay to %s", mergeO.Value)
 
-		outO := &FileOption{
-			LeadingDetachedComments: append([]string{}, mergeO.LeadingDetachedComments...),
-			LeadingComments:         mergeO.LeadingComments,
-			TrailingComments:        mergeO.TrailingComments,
-			Name:                    mergeO.Name,
-			Value:                   mergeO.Value,
+		outO := &Option{
+			Comments: s.mergeComments(Comments{}, mergeO.Comments),
+			Name:     name,
+			Value:    s.rewriteOption(mergeO.Value),
 		}
 
 		if first {
 			first = false
-			outO.LeadingDetachedComments = append([]string{"//////\n Options from merge\n//////\n"}, outO.LeadingDetachedComments...)
+			s.addBanner(&outO.Comments, "Options", "merge")
 		}
 
+		s.report.add(&ReportEntry{
+			Kind:   KindOption,
+			Path:   scopedName(scope, outO.Name),
+			Origin: OriginOverlay,
+		})
+
 		out = append(out, outO)
 		outMap[outO.Name] = outO
 	}
@@ -214,7 +315,7 @@ func (s *MergeSpec) mergeOptions(base, merge *File) []*FileOption {
 	return out
 }
 
-func (s *MergeSpec) mergeEnums(base, merge, merged EnumHaver) []*Enum {
+func (s *merger) mergeEnums(scope string, base, merge, merged EnumHaver) []*Enum {
 	out := []*Enum{}
 	outMap := map[string]*Enum{}
 
@@ -236,7 +337,9 @@ func (s *MergeSpec) mergeEnums(base, merge, merged EnumHaver) []*Enum {
 	first := true
 	for _, baseE := range base.GetEnums() {
 		mergeE, ok := mergeMap[baseE.Name]
+		origin := OriginBoth
 		if !ok {
+			origin = OriginBase
 			mergeE = &Enum{
 				Name: baseE.Name,
 			}
@@ -249,77 +352,84 @@ func (s *MergeSpec) mergeEnums(base, merge, merged EnumHaver) []*Enum {
 			}
 		}
 
-		outE := s.mergeEnum(baseE, mergeE, mergedE)
+		path := scopedName(scope, baseE.Name)
+		s.report.add(&ReportEntry{
+			Kind:   KindEnum,
+			Path:   path,
+			Origin: origin,
+		})
+
+		outE := s.mergeEnum(path, baseE, mergeE, mergedE)
 
 		if first {
 			first = false
-			outE.LeadingDetachedComments = append([]string{"//////\n Enums from base\n//////\n"}, outE.LeadingDetachedComments...)
+			s.addBanner(&outE.Comments, "Enums", "base")
 		}
 
 		out = append(out, outE)
 		outMap[outE.Name] = outE
 	}
 
-	// first = true
-	// for _, mergeE := range merge.GetEnums() {
-	// 	if _, ok := outMap[mergeE.Name]; ok {
-	// 		continue
-	// 	}
+	if !s.passThrough {
+		return out
+	}
 
-	// 	baseE := &Enum{
-	// 		Name: mergeE.Name,
-	// 	}
+	first = true
+	for _, mergeE := range merge.GetEnums() {
+		if _, ok := outMap[mergeE.Name]; ok {
+			continue
+		}
 
-	// 	mergedE, ok := mergedMap[mergeE.Name]
-	// 	if !ok {
-	// 		mergedE = &Enum{
-	// 			Name: mergeE.Name,
-	// 		}
-	// 	}
+		mergedE, ok := mergedMap[mergeE.Name]
+		if !ok {
+			mergedE = &Enum{
+				Name: mergeE.Name,
+			}
+		}
 
-	// 	outE := s.mergeEnum(baseE, mergeE, mergedE)
+		path := scopedName(scope, mergeE.Name)
+		s.report.add(&ReportEntry{
+			Kind:   KindEnum,
+			Path:   path,
+			Origin: OriginOverlay,
+		})
 
-	// 	if first {
-	// 		first = false
-	// 		outE.LeadingDetachedComments = append([]string{"//////\n Enums from merge\n//////\n"}, outE.LeadingDetachedComments...)
-	// 	}
+		outE := s.mergeEnum(path, &Enum{Name: mergeE.Name}, mergeE, mergedE)
 
-	// 	out = append(out, mergeE)
-	// }
+		if first {
+			first = false
+			s.addBanner(&outE.Comments, "Enums", "merge")
+		}
+
+		out = append(out, outE)
+		outMap[outE.Name] = outE
+	}
 
 	return out
 }
 
-func (s *MergeSpec) mergeEnum(base, merge, merged *Enum) *Enum {
+func (s *merger) mergeEnum(path string, base, merge, merged *Enum) *Enum {
 	out := &Enum{
-		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
-		LeadingComments:         base.LeadingComments,
-		TrailingComments:        base.TrailingComments,
-		Name:                    base.Name,
-	}
-	if len(merge.LeadingComments) > 0 {
-		out.LeadingComments = merge.LeadingComments
-	}
-	if len(merge.TrailingComments) > 0 {
-		out.TrailingComments = merge.TrailingComments
+		Comments: s.mergeComments(base.Comments, merge.Comments),
+		Name:     base.Name,
+		Options:  s.mergeOptions(path, base.Options, merge.Options),
 	}
 
 	outMap := map[string]*EnumValue{}
 
-	usedNumbers := map[int32]bool{}
-
-	numberer := newNumberer(0)
-	for _, v := range merged.ReservedRanges {
-		for i := v.Start; i <= v.End; i++ {
-			numberer.use("", i)
+	numberer := newNumberer(0, maxEnumNumber)
+	for _, ranges := range [][]*ReservedRange{base.ReservedRanges, merge.ReservedRanges, merged.ReservedRanges} {
+		for _, v := range ranges {
+			numberer.exclude(v.Start, v.End)
 		}
 	}
 	for _, v := range merged.Values {
 		numberer.use(v.Name, v.Number)
 	}
-
-	for _, v := range merged.Values {
-		usedNumbers[v.Number] = true
+	if s.passThrough {
+		for _, v := range append(slices.Clone(base.Values), merge.Values...) {
+			numberer.hint(v.Name, v.Number)
+		}
 	}
 
 	reservedNames := map[string]bool{}
@@ -327,6 +437,10 @@ func (s *MergeSpec) mergeEnum(base, merge, merged *Enum) *Enum {
 		reservedNames[r.Name] = true
 	}
 
+	for _, v := range merge.Values {
+		s.checkReserved(path, "enum value", v.Name, v.Number, base.ReservedRanges, base.ReservedNames)
+	}
+
 	mergeMap := map[string]*EnumValue{}
 	for _, v := range merge.Values {
 		mergeMap[v.Name] = v
@@ -337,24 +451,60 @@ func (s *MergeSpec) mergeEnum(base, merge, merged *Enum) *Enum {
 		mergedMap[v.Name] = v
 	}
 
+	// With allow_alias, values that share a number in their layer share it
+	// in the output too, the first of them gets the number
+	allowAlias := false
+	for _, o := range out.Options {
+		if o.Name == "allow_alias" && o.Value == "true" {
+			allowAlias = true
+		}
+	}
+	aliases := func(values []*EnumValue) map[string]string {
+		out := map[string]string{}
+		if !allowAlias {
+			return out
+		}
+		first := map[int32]string{}
+		for _, v := range values {
+			if reservedNames[v.Name] {
+				continue
+			}
+			if name, ok := first[v.Number]; ok {
+				out[v.Name] = name
+				continue
+			}
+			first[v.Number] = v.Name
+		}
+		return out
+	}
+	baseAliases := aliases(base.Values)
+	mergeAliases := aliases(merge.Values)
+
 	first := true
 	for _, baseV := range base.Values {
 		if reservedNames[baseV.Name] {
+			s.report.add(&ReportEntry{
+				Kind:   KindReserved,
+				Path:   scopedName(path, baseV.Name),
+				Reason: "name reserved by overlay",
+			})
 			continue
 		}
 
 		mergeV, ok := mergeMap[baseV.Name]
+		origin := OriginBoth
 		if !ok {
+			origin = OriginBase
 			mergeV = &EnumValue{
 				Name: baseV.Name,
 			}
 		}
 
-		outV := s.mergeEnumValue(baseV, mergeV, numberer)
+		outV := s.mergeEnumValue(path, origin, baseV, mergeV, baseAliases[baseV.Name], numberer)
 
 		if first {
 			first = false
-			outV.LeadingDetachedComments = append([]string{"//////\n Values from base\n//////\n"}, outV.LeadingDetachedComments...)
+			s.addBanner(&outV.Comments, "Values", "base")
 		}
 
 		out.Values = append(out.Values, outV)
@@ -371,68 +521,103 @@ func (s *MergeSpec) mergeEnum(base, merge, merged *Enum) *Enum {
 			Name: mergeV.Name,
 		}
 
-		outV := s.mergeEnumValue(baseV, mergeV, numberer)
+		outV := s.mergeEnumValue(path, OriginOverlay, baseV, mergeV, mergeAliases[mergeV.Name], numberer)
 
 		if first {
 			first = false
-			outV.LeadingDetachedComments = append([]string{"//////\n Values from merge\n//////\n"}, outV.LeadingDetachedComments...)
+			s.addBanner(&outV.Comments, "Values", "merge")
 		}
 
 		out.Values = append(out.Values, outV)
 		outMap[outV.Name] = outV
 	}
 
-	out.ReservedNames = append(out.ReservedNames, merge.ReservedNames...)
+	removedRanges := []*ReservedRange{}
+	removedNames := []*ReservedName{}
+
+	outNumbers := map[int32]bool{}
+	for _, v := range out.Values {
+		outNumbers[v.Number] = true
+	}
 
 	for _, mergedV := range merged.Values {
 		if _, ok := outMap[mergedV.Name]; ok {
 			continue
 		}
-		out.ReservedRanges = append(out.ReservedRanges, &ReservedRange{
-			LeadingComments: fmt.Sprintf("Reserved because the field %s was removed\n", mergedV.Name),
-			Start:           mergedV.Number,
-			End:             mergedV.Number,
+		// A removed alias only frees its name, the number is still in use
+		if outNumbers[mergedV.Number] {
+			removedNames = append(removedNames, &ReservedName{Name: mergedV.Name})
+			s.report.add(&ReportEntry{
+				Kind:   KindReserved,
+				Path:   scopedName(path, mergedV.Name),
+				Reason: fmt.Sprintf("enum value %s was removed", mergedV.Name),
+			})
+			continue
+		}
+		removedRanges = append(removedRanges, &ReservedRange{
+			Comments: Comments{
+				LeadingComments: fmt.Sprintf(" Reserved because the field %s was removed\n", mergedV.Name),
+			},
+			Start: mergedV.Number,
+			End:   mergedV.Number,
+		})
+		s.report.add(&ReportEntry{
+			Kind:   KindReserved,
+			Path:   scopedName(path, mergedV.Name),
+			Number: ptr(mergedV.Number),
+			Reason: fmt.Sprintf("enum value %s was removed", mergedV.Name),
 		})
 
-		outR := &ReservedName{
-			Name: mergedV.Name,
-		}
-		if !reservedNames[mergedV.Name] {
-			out.ReservedNames = append(out.ReservedNames, outR)
-		}
+		removedNames = append(removedNames, &ReservedName{Name: mergedV.Name})
 	}
 
-	for _, n := range merged.ReservedNames {
-		if reservedNames[n.Name] {
-			continue
-		}
-		out.ReservedNames = append(out.ReservedNames, n)
-	}
-	out.ReservedRanges = append(out.ReservedRanges, merged.ReservedRanges...)
+	out.ReservedRanges = s.mergeReservedRanges(base.ReservedRanges, merge.ReservedRanges, merged.ReservedRanges, removedRanges)
+	out.ReservedNames = s.mergeReservedNames(base.ReservedNames, merge.ReservedNames, merged.ReservedNames, removedNames)
 
 	return out
 }
 
-func (s *MergeSpec) mergeEnumValue(base, merge *EnumValue, numberer *numberer) *EnumValue {
+// mergeEnumValue merges a value, alias is the name of the value it shares
+// its number with, if any.
+func (s *merger) mergeEnumValue(scope string, origin Origin, base, merge *EnumValue, alias string, numberer *numberer) *EnumValue {
 	out := &EnumValue{
-		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
-		LeadingComments:         base.LeadingComments,
-		TrailingComments:        base.TrailingComments,
-		Name:                    base.Name,
-	}
-	if len(merge.LeadingComments) > 0 {
-		out.LeadingComments = merge.LeadingComments
+		Comments: s.mergeComments(base.Comments, merge.Comments),
+		Name:     base.Name,
+	}
+	out.Options = s.mergeOptions(scopedName(scope, out.Name), base.Options, merge.Options)
+
+	numbering := NumberAllocated
+	var err error
+	switch {
+	case numberer.pinned(out.Name):
+		numbering = NumberReused
+		out.Number, err = numberer.number(out.Name)
+	case alias != "":
+		numbering = NumberAliased
+		out.Number, err = numberer.alias(out.Name, alias)
+	default:
+		out.Number, err = numberer.number(out.Name)
+	}
+	if err != nil {
+		s.errorf("enum value %s: %w", scopedName(scope, out.Name), err)
+	}
+
+	s.report.add(&ReportEntry{
+		Kind:      KindEnumValue,
+		Path:      scopedName(scope, out.Name),
+		Origin:    origin,
+		Number:    ptr(out.Number),
+		Numbering: numbering,
+	})
+	if numbering == NumberAllocated && !s.passThrough {
+		layer, at := declared(base.Position, merge.Position)
+		s.logf(LevelInfo, layer, at, scopedName(scope, out.Name), "allocated number %d", out.Number)
 	}
-	if len(merge.TrailingComments) > 0 {
-		out.TrailingComments = merge.TrailingComments
-	}
-
-	out.Number = numberer.number(out.Name)
 
 	return out
 }
 
-func (s *MergeSpec) mergeMessages(base, merge, merged MessageHaver) []*Message {
+func (s *merger) mergeMessages(scope string, base, merge, merged MessageHaver) []*Message {
 	out := []*Message{}
 	outMap := map[string]*Message{}
 
@@ -454,8 +639,17 @@ func (s *MergeSpec) mergeMessages(base, merge, merged MessageHaver) []*Message {
 	first := true
 	for _, baseM := range base.GetMessages() {
 		mergeM, ok := mergeMap[baseM.Name]
+		origin := OriginBoth
 		if !ok {
-			continue
+			// Messages only base has are dropped, unless base is carried
+			// over as it is
+			if !s.passThrough {
+				continue
+			}
+			origin = OriginBase
+			mergeM = &Message{
+				Name: baseM.Name,
+			}
 		}
 
 		mergedM, ok := mergedMap[baseM.Name]
@@ -465,63 +659,76 @@ func (s *MergeSpec) mergeMessages(base, merge, merged MessageHaver) []*Message {
 			}
 		}
 
-		outM := s.mergeMessage(baseM, mergeM, mergedM)
+		path := scopedName(scope, baseM.Name)
+		s.report.add(&ReportEntry{
+			Kind:   KindMessage,
+			Path:   path,
+			Origin: origin,
+		})
+
+		outM := s.mergeMessage(path, baseM, mergeM, mergedM)
 
 		if first {
 			first = false
-			outM.LeadingDetachedComments = append([]string{"//////\n Messages from base\n//////\n"}, baseM.LeadingDetachedComments...)
+			s.addBanner(&outM.Comments, "Messages", "base")
 		}
 
 		out = append(out, outM)
 		outMap[outM.Name] = outM
 	}
 
-	// first = true
-	// for _, mergeM := range merge.GetMessages() {
-	// 	baseM := &Message{
-	// 		Name: mergeM.Name,
-	// 	}
+	if !s.passThrough {
+		return out
+	}
 
-	// 	mergedM, ok := mergedMap[mergeM.Name]
-	// 	if !ok {
-	// 		mergedM = &Message{
-	// 			Name: mergeM.Name,
-	// 		}
-	// 	}
-	// 	outM := s.mergeMessage(baseM, mergeM, mergedM)
+	first = true
+	for _, mergeM := range merge.GetMessages() {
+		if _, ok := outMap[mergeM.Name]; ok {
+			continue
+		}
 
-	// 	if first {
-	// 		first = false
-	// 		outM.LeadingDetachedComments = append([]string{"//////\n Messages from merge\n//////\n"}, outM.LeadingDetachedComments...)
-	// 	}
+		mergedM, ok := mergedMap[mergeM.Name]
+		if !ok {
+			mergedM = &Message{
+				Name: mergeM.Name,
+			}
+		}
 
-	// 	out = append(out, outM)
-	// }
+		path := scopedName(scope, mergeM.Name)
+		s.report.add(&ReportEntry{
+			Kind:   KindMessage,
+			Path:   path,
+			Origin: OriginOverlay,
+		})
+
+		outM := s.mergeMessage(path, &Message{Name: mergeM.Name}, mergeM, mergedM)
+
+		if first {
+			first = false
+			s.addBanner(&outM.Comments, "Messages", "merge")
+		}
+
+		out = append(out, outM)
+		outMap[outM.Name] = outM
+	}
 
 	return out
 }
 
-func (s *MergeSpec) mergeMessage(base, merge, merged *Message) *Message {
+func (s *merger) mergeMessage(path string, base, merge, merged *Message) *Message {
 	out := &Message{
-		Name:                    base.Name,
-		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
-		LeadingComments:         base.LeadingComments,
-		TrailingComments:        base.TrailingComments,
-	}
-	if len(merge.LeadingComments) > 0 {
-		out.LeadingComments = merge.LeadingComments
-	}
-	if len(merge.TrailingComments) > 0 {
-		out.TrailingComments = merge.TrailingComments
+		Name:     base.Name,
+		Comments: s.mergeComments(base.Comments, merge.Comments),
 	}
 
-	out.Enums = s.mergeEnums(base, merge, merged)
-	out.Messages = s.mergeMessages(base, merge, merged)
+	out.Options = s.mergeOptions(path, base.Options, merge.Options)
+	out.Enums = s.mergeEnums(path, base, merge, merged)
+	out.Messages = s.mergeMessages(path, base, merge, merged)
 
-	numberer := newNumberer(1)
-	for _, f := range merged.ReservedRanges {
-		for i := f.Start; i <= f.End; i++ {
-			numberer.use("", i)
+	numberer := newFieldNumberer()
+	for _, ranges := range [][]*ReservedRange{base.ReservedRanges, merge.ReservedRanges, merged.ReservedRanges} {
+		for _, f := range ranges {
+			numberer.exclude(f.Start, f.End)
 		}
 	}
 
@@ -535,12 +742,32 @@ func (s *MergeSpec) mergeMessage(base, merge, merged *Message) *Message {
 		}
 	}
 
+	// A copied file keeps its numbers, or it wouldn't be wire compatible
+	if s.passThrough {
+		for _, f := range append(allFields(base), allFields(merge)...) {
+			numberer.hint(f.Name, f.Number)
+		}
+	}
+
+	// Only proto2 has extension ranges, protoc rejects them elsewhere
+	if s.syntax == "proto2" {
+		out.ExtensionRanges = s.mergeExtensionRanges(path, base, merge)
+	}
+	for _, r := range out.ExtensionRanges {
+		numberer.exclude(r.Start, r.End)
+	}
+
 	reservedNames := map[string]bool{}
 	for _, r := range merge.ReservedNames {
 		reservedNames[r.Name] = true
 	}
 
-	out.Fields = s.mergeFields(base, merge, numberer, reservedNames)
+	fields := newMessageFields(base, merge, numberer, reservedNames)
+	for _, f := range allFields(merge) {
+		s.checkReserved(path, "field", f.Name, f.Number, base.ReservedRanges, base.ReservedNames)
+	}
+	out.Fields = s.mergeFields(path, "", base, merge, fields)
+	out.Extensions = s.mergeExtensions(path, base, merge, merged)
 
 	// merge oneofs
 	outOneofMap := map[string]*Oneof{}
@@ -569,9 +796,16 @@ func (s *MergeSpec) mergeMessage(base, merge, merged *Message) *Message {
 			}
 		}
 
-		outOneof := s.mergeOneof(baseOneof, mergeOneof, numberer, reservedNames)
+		outOneof := s.mergeOneof(path, baseOneof, mergeOneof, fields)
+		// All of its fields were moved out by the overlay
+		if len(outOneof.Fields) == 0 {
+			continue
+		}
 
-		outOneof.LeadingDetachedComments = append([]string{"//////\n Oneofs from base\n//////\n"}, outOneof.LeadingDetachedComments...)
+		if first {
+			first = false
+			s.addBanner(&outOneof.Comments, "Oneofs", "base")
+		}
 
 		out.Oneofs = append(out.Oneofs, outOneof)
 		outOneofMap[outOneof.Name] = outOneof
@@ -587,91 +821,139 @@ func (s *MergeSpec) mergeMessage(base, merge, merged *Message) *Message {
 			Name: mergeOneof.Name,
 		}
 
-		outOneof := s.mergeOneof(baseOneof, mergeOneof, numberer, reservedNames)
+		outOneof := s.mergeOneof(path, baseOneof, mergeOneof, fields)
 
 		if first {
 			first = false
-			outOneof.LeadingDetachedComments = append([]string{"//////\n Oneofs from merge\n//////\n"}, outOneof.LeadingDetachedComments...)
+			s.addBanner(&outOneof.Comments, "Oneofs", "merge")
 		}
 
 		out.Oneofs = append(out.Oneofs, outOneof)
 	}
 
 	outFields := map[string]*Field{}
-	for _, f := range out.Fields {
+	for _, f := range allFields(out) {
 		outFields[f.Name] = f
 	}
 
-	for _, oneof := range out.Oneofs {
-		for _, f := range oneof.Fields {
-			outFields[f.Name] = f
-		}
-	}
-
-	// handle removed fields
-	out.ReservedNames = append(out.ReservedNames, merge.ReservedNames...)
-
-	for _, n := range merged.ReservedNames {
-		if reservedNames[n.Name] {
-			continue
-		}
-		out.ReservedNames = append(out.ReservedNames, n)
-	}
-	for _, f := range merged.Fields {
+	// Fields of the previous output that are gone are reserved
+	removedRanges := []*ReservedRange{}
+	removedNames := []*ReservedName{}
+	for _, f := range allFields(merged) {
 		if _, ok := outFields[f.Name]; ok {
 			continue
 		}
-		out.ReservedRanges = append(out.ReservedRanges, &ReservedRange{
-			LeadingComments: fmt.Sprintf(" Reserved because the field %s was removed\n", f.Name),
-			Start:           f.Number,
-			End:             f.Number,
+		removedRanges = append(removedRanges, &ReservedRange{
+			Comments: Comments{
+				LeadingComments: fmt.Sprintf(" Reserved because the field %s was removed\n", f.Name),
+			},
+			Start: f.Number,
+			End:   f.Number,
 		})
-		if !reservedNames[f.Name] {
-			out.ReservedNames = append(out.ReservedNames, &ReservedName{
-				Name: f.Name,
-			})
-		}
+		s.report.add(&ReportEntry{
+			Kind:   KindReserved,
+			Path:   scopedName(path, f.Name),
+			Number: ptr(f.Number),
+			Reason: fmt.Sprintf("field %s was removed", f.Name),
+		})
+		removedNames = append(removedNames, &ReservedName{Name: f.Name})
 	}
 
-	out.ReservedRanges = append(out.ReservedRanges, merged.ReservedRanges...)
+	out.ReservedRanges = s.mergeReservedRanges(base.ReservedRanges, merge.ReservedRanges, merged.ReservedRanges, removedRanges)
+	out.ReservedNames = s.mergeReservedNames(base.ReservedNames, merge.ReservedNames, merged.ReservedNames, removedNames)
+
+	s.order(s.messageElements(out), s.messageElements(base), s.messageElements(merge))
 
 	return out
 }
 
-func (s *MergeSpec) mergeFields(base, merge FieldHaver, numberer *numberer, reservedNames map[string]bool) []*Field {
-	out := []*Field{}
-	outMap := map[string]*Field{}
+// messageFields are the fields of a message in both layers, including the
+// ones in oneofs, so that a field is only written once even when the layers
+// put it in different places.
+type messageFields struct {
+	base  map[string]*Field
+	merge map[string]*Field
+	// baseOneofs and mergeOneofs are the oneof each field is in, or "" for
+	// plain fields
+	baseOneofs  map[string]string
+	mergeOneofs map[string]string
+
+	numberer      *numberer
+	reservedNames map[string]bool
+}
 
-	baseMap := map[string]*Field{}
-	for _, f := range base.GetFields() {
-		baseMap[f.Name] = f
+func newMessageFields(base, merge *Message, numberer *numberer, reservedNames map[string]bool) *messageFields {
+	fields := &messageFields{
+		base:          map[string]*Field{},
+		merge:         map[string]*Field{},
+		baseOneofs:    map[string]string{},
+		mergeOneofs:   map[string]string{},
+		numberer:      numberer,
+		reservedNames: reservedNames,
+	}
+	add := func(m *Message, all map[string]*Field, oneofs map[string]string) {
+		for _, f := range m.Fields {
+			all[f.Name] = f
+		}
+		for _, oneof := range m.Oneofs {
+			for _, f := range oneof.Fields {
+				all[f.Name] = f
+				oneofs[f.Name] = oneof.Name
+			}
+		}
 	}
+	add(base, fields.base, fields.baseOneofs)
+	add(merge, fields.merge, fields.mergeOneofs)
+	return fields
+}
 
-	mergeMap := map[string]*Field{}
-	for _, f := range merge.GetFields() {
-		mergeMap[f.Name] = f
+// oneof returns the oneof the field ends up in. The overlay decides, base
+// only decides for fields the overlay doesn't have.
+func (fields *messageFields) oneof(name string) string {
+	if _, ok := fields.merge[name]; ok {
+		return fields.mergeOneofs[name]
 	}
+	return fields.baseOneofs[name]
+}
+
+// mergeFields merges the fields of the oneof named oneof, or the plain fields
+// if it is empty.
+func (s *merger) mergeFields(scope string, oneof string, base, merge FieldHaver, fields *messageFields) []*Field {
+	out := []*Field{}
+	outMap := map[string]*Field{}
 
 	first := true
 	for _, baseF := range base.GetFields() {
-		if reservedNames[baseF.Name] {
+		if fields.oneof(baseF.Name) != oneof {
+			// The overlay moved it, it's written where the overlay has it
+			continue
+		}
+		if fields.reservedNames[baseF.Name] {
+			s.report.add(&ReportEntry{
+				Kind:   KindReserved,
+				Path:   scopedName(scope, baseF.Name),
+				Reason: "name reserved by overlay",
+			})
 			continue
 		}
 
-		mergeF, ok := mergeMap[baseF.Name]
+		mergeF, ok := fields.merge[baseF.Name]
+		origin := OriginBoth
 		if !ok {
+			origin = OriginBase
 			mergeF = &Field{
 				Label: baseF.Label,
+				Key:   baseF.Key,
 				Type:  baseF.Type,
 				Name:  baseF.Name,
 			}
 		}
 
-		outF := s.mergeField(baseF, mergeF, numberer)
+		outF, _ := s.mergeField(scope, origin, baseF, mergeF, fields.numberer)
 
 		if first {
 			first = false
-			outF.LeadingDetachedComments = append([]string{"//////\n Fields from base\n//////\n"}, outF.LeadingDetachedComments...)
+			s.addBanner(&outF.Comments, "Fields", "base")
 		}
 
 		out = append(out, outF)
@@ -684,17 +966,33 @@ func (s *MergeSpec) mergeFields(base, merge FieldHaver, numberer *numberer, rese
 			continue
 		}
 
-		baseF := &Field{
-			Label: mergeF.Label,
-			Type:  mergeF.Type,
-			Name:  mergeF.Name,
+		origin := OriginOverlay
+		baseF, ok := fields.base[mergeF.Name]
+		if ok && !fields.reservedNames[mergeF.Name] {
+			origin = OriginBoth
+		} else {
+			baseF = &Field{
+				Label: mergeF.Label,
+				Key:   mergeF.Key,
+				Type:  mergeF.Type,
+				Name:  mergeF.Name,
+			}
 		}
 
-		outF := s.mergeField(baseF, mergeF, numberer)
+		outF, entry := s.mergeField(scope, origin, baseF, mergeF, fields.numberer)
+		if origin == OriginBoth {
+			// The field is in another oneof in base, changing the oneof
+			// changes which fields clear each other
+			entry.OneofChanged = true
+			entry.Oneof = oneof
+			entry.BaseOneof = fields.baseOneofs[mergeF.Name]
+			layer, at := declared(baseF.Position, mergeF.Position)
+			s.logf(LevelWarn, layer, at, entry.Path, "moved from %s to %s, this changes which fields clear each other", describeOneof(entry.BaseOneof), describeOneof(oneof))
+		}
 
 		if first {
 			first = false
-			outF.LeadingDetachedComments = append([]string{"//////\n Fields from merge\n//////\n"}, outF.LeadingDetachedComments...)
+			s.addBanner(&outF.Comments, "Fields", "merge")
 		}
 
 		out = append(out, outF)
@@ -704,47 +1002,551 @@ func (s *MergeSpec) mergeFields(base, merge FieldHaver, numberer *numberer, rese
 	return out
 }
 
-func (s *MergeSpec) mergeField(base, merge *Field, numberer *numberer) *Field {
+// mergeField merges a field and returns it with its report entry.
+func (s *merger) mergeField(scope string, origin Origin, base, merge *Field, numberer *numberer) (*Field, *ReportEntry) {
 	out := &Field{
-		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
-		LeadingComments:         base.LeadingComments,
-		TrailingComments:        base.TrailingComments,
-		Name:                    base.Name,
-		Label:                   merge.Label,
-		Type:                    merge.Type,
+		Comments: s.mergeComments(base.Comments, merge.Comments),
+		Name:     base.Name,
+		Label:    merge.Label,
+		Key:      merge.Key,
+		Type:     merge.Type,
 	}
-	if len(merge.LeadingComments) > 0 {
-		out.LeadingComments = merge.LeadingComments
+
+	out.Type = s.rewriteType(merge.Type)
+
+	numbering := NumberAllocated
+	if numberer.pinned(out.Name) {
+		numbering = NumberReused
 	}
-	if len(merge.TrailingComments) > 0 {
-		out.TrailingComments = merge.TrailingComments
+	number, err := numberer.number(out.Name)
+	if err != nil {
+		s.errorf("field %s: %w", scopedName(scope, out.Name), err)
 	}
+	out.Number = number
 
-	replace := fmt.Sprintf(".%s", s.MergePackage)
-	if strings.HasPrefix(merge.Type, replace) {
-		out.Type = strings.Replace(out.Type, replace, fmt.Sprintf(".%s", s.MergedPackage), 1)
+	entry := &ReportEntry{
+		Kind:      KindField,
+		Path:      scopedName(scope, out.Name),
+		Origin:    origin,
+		Type:      fieldType(out),
+		Number:    ptr(out.Number),
+		Numbering: numbering,
+	}
+	layer, at := declared(base.Position, merge.Position)
+	if origin == OriginBoth && (base.Key != merge.Key || !s.sameType(base.Type, merge.Type)) {
+		entry.TypeChanged = true
+		entry.BaseType = fieldType(base)
+		s.logf(LevelWarn, layer, at, entry.Path, "type changed from %s to %s", fieldType(base), fieldType(merge))
 	}
+	if numbering == NumberAllocated && !s.passThrough {
+		s.logf(LevelInfo, layer, at, entry.Path, "allocated number %d", out.Number)
+	}
+	s.report.add(entry)
+
+	return out, entry
+}
 
-	out.Number = numberer.number(out.Name)
+// mergeExtensionRanges returns the union of the extension ranges of both
+// layers, overlapping and adjacent ranges are combined. The overlay removes
+// a base range, or part of one, by reserving it.
+func (s *merger) mergeExtensionRanges(path string, base, merge *Message) []*ExtensionRange {
+	type origined struct {
+		*ExtensionRange
+		origin Origin
+	}
+	ranges := []origined{}
+
+	for _, baseR := range base.ExtensionRanges {
+		pieces := [][2]int32{{baseR.Start, baseR.End}}
+		for _, removed := range merge.ReservedRanges {
+			next := [][2]int32{}
+			for _, p := range pieces {
+				if removed.End < p[0] || p[1] < removed.Start {
+					next = append(next, p)
+					continue
+				}
+				s.report.add(&ReportEntry{
+					Kind:   KindExtensionRange,
+					Path:   path,
+					Reason: fmt.Sprintf("extensions %s reserved by overlay", formatRange(max(p[0], removed.Start), min(p[1], removed.End), maxFieldNumber)),
+				})
+				if p[0] < removed.Start {
+					next = append(next, [2]int32{p[0], removed.Start - 1})
+				}
+				if removed.End < p[1] {
+					next = append(next, [2]int32{removed.End + 1, p[1]})
+				}
+			}
+			pieces = next
+		}
+		for _, p := range pieces {
+			ranges = append(ranges, origined{
+				ExtensionRange: &ExtensionRange{
+					Comments: s.mergeComments(baseR.Comments, Comments{}),
+					Start:    p[0],
+					End:      p[1],
+					Options:  baseR.Options,
+				},
+				origin: OriginBase,
+			})
+		}
+	}
+	for _, mergeR := range merge.ExtensionRanges {
+		ranges = append(ranges, origined{
+			ExtensionRange: &ExtensionRange{
+				Comments: s.mergeComments(Comments{}, mergeR.Comments),
+				Start:    mergeR.Start,
+				End:      mergeR.End,
+				Options:  mergeR.Options,
+			},
+			origin: OriginOverlay,
+		})
+	}
 
+	slices.SortStableFunc(ranges, func(a, b origined) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	combined := []origined{}
+	for _, r := range ranges {
+		if len(combined) == 0 {
+			combined = append(combined, r)
+			continue
+		}
+		last := &combined[len(combined)-1]
+		// Compared in int64, End can be the largest field number
+		if int64(r.Start) > int64(last.End)+1 {
+			combined = append(combined, r)
+			continue
+		}
+		last.End = max(last.End, r.End)
+		last.Comments = s.mergeComments(last.Comments, r.Comments)
+		for _, o := range r.Options {
+			if !slices.ContainsFunc(last.Options, func(other *Option) bool {
+				return other.Name == o.Name && other.Value == o.Value
+			}) {
+				last.Options = append(slices.Clip(last.Options), o)
+			}
+		}
+		if last.origin != r.origin {
+			last.origin = OriginBoth
+		}
+	}
+
+	out := []*ExtensionRange{}
+	for _, r := range combined {
+		s.report.add(&ReportEntry{
+			Kind:   KindExtensionRange,
+			Path:   path,
+			Origin: r.origin,
+			Reason: "extensions " + formatRange(r.Start, r.End, maxFieldNumber),
+		})
+		out = append(out, r.ExtensionRange)
+	}
 	return out
 }
 
-func (s *MergeSpec) mergeOneof(base, merge *Oneof, numberer *numberer, reservedNames map[string]bool) *Oneof {
-	out := &Oneof{
-		LeadingDetachedComments: append(append([]string{}, base.LeadingDetachedComments...), merge.LeadingDetachedComments...),
-		LeadingComments:         base.LeadingComments,
-		TrailingComments:        base.TrailingComments,
-		Name:                    base.Name,
+// allFields returns the fields of m, including the ones in oneofs.
+func allFields(m *Message) []*Field {
+	out := slices.Clone(m.Fields)
+	for _, oneof := range m.Oneofs {
+		out = append(out, oneof.Fields...)
+	}
+	return out
+}
+
+// checkReserved reports an error if the overlay declares an element with a
+// name or number that base reserved.
+func (s *merger) checkReserved(path, kind, name string, number int32, ranges []*ReservedRange, names []*ReservedName) {
+	for _, n := range names {
+		if n.Name == name {
+			s.errorf("%s: %s %s uses a name reserved in base", path, kind, name)
+		}
+	}
+	for _, r := range ranges {
+		if r.Start <= number && number <= r.End {
+			s.errorf("%s: %s %s uses the number %d reserved in base", path, kind, name, number)
+		}
+	}
+}
+
+// mergeReservedRanges returns the union of the reserved ranges of every
+// layer and the ones reserved for removed elements.
+func (s *merger) mergeReservedRanges(base, merge, merged, removed []*ReservedRange) []*ReservedRange {
+	out := []*ReservedRange{}
+	for _, r := range base {
+		out = append(out, &ReservedRange{Comments: s.mergeComments(r.Comments, Comments{}), Start: r.Start, End: r.End})
+	}
+	for _, r := range merge {
+		out = append(out, &ReservedRange{Comments: s.mergeComments(Comments{}, r.Comments), Start: r.Start, End: r.End})
+	}
+	out = append(out, merged...)
+	out = append(out, removed...)
+	return coalesceRanges(out)
+}
+
+// mergeReservedNames returns the reserved names of every layer and the ones
+// reserved for removed elements, each name once.
+func (s *merger) mergeReservedNames(base, merge, merged, removed []*ReservedName) []*ReservedName {
+	out := []*ReservedName{}
+	seen := map[string]bool{}
+	add := func(n *ReservedName, comments Comments) {
+		if seen[n.Name] {
+			return
+		}
+		seen[n.Name] = true
+		out = append(out, &ReservedName{Comments: comments, Name: n.Name})
+	}
+	for _, n := range base {
+		add(n, s.mergeComments(n.Comments, Comments{}))
+	}
+	for _, n := range merge {
+		add(n, s.mergeComments(Comments{}, n.Comments))
+	}
+	for _, n := range append(slices.Clone(merged), removed...) {
+		add(n, n.Comments)
+	}
+	return out
+}
+
+// coalesceRanges sorts reserved ranges and combines the ones that overlap or
+// are adjacent, along with their comments.
+func coalesceRanges(ranges []*ReservedRange) []*ReservedRange {
+	sorted := slices.Clone(ranges)
+	slices.SortStableFunc(sorted, func(a, b *ReservedRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	out := []*ReservedRange{}
+	for _, r := range sorted {
+		if len(out) == 0 || int64(r.Start) > int64(out[len(out)-1].End)+1 {
+			copied := *r
+			out = append(out, &copied)
+			continue
+		}
+		last := out[len(out)-1]
+		last.End = max(last.End, r.End)
+		// The same range is often in several layers, with the same comments
+		for _, d := range r.LeadingDetachedComments {
+			if !slices.Contains(last.LeadingDetachedComments, d) {
+				last.LeadingDetachedComments = append(slices.Clip(last.LeadingDetachedComments), d)
+			}
+		}
+		if !strings.Contains(last.LeadingComments, r.LeadingComments) {
+			last.LeadingComments += r.LeadingComments
+		}
+		if r.TrailingComments != "" {
+			last.TrailingComments = r.TrailingComments
+		}
+	}
+	return out
+}
+
+// mergeExtensions merges extend blocks by extendee, and their fields by
+// name. The blocks of a layer that extend the same message are combined.
+func (s *merger) mergeExtensions(scope string, base, merge, merged ExtensionHaver) []*Extension {
+	out := []*Extension{}
+
+	group := func(pkg string, extensions []*Extension) ([]string, map[string]*Extension) {
+		keys := []string{}
+		groups := map[string]*Extension{}
+		for _, e := range extensions {
+			key := s.localType(pkg, e.Extendee)
+			g, ok := groups[key]
+			if !ok {
+				g = &Extension{Comments: e.Comments, Extendee: e.Extendee}
+				groups[key] = g
+				keys = append(keys, key)
+			}
+			g.Fields = append(g.Fields, e.Fields...)
+		}
+		return keys, groups
+	}
+	baseKeys, baseGroups := group(s.basePackage, base.GetExtensions())
+	mergeKeys, mergeGroups := group(s.mergePackage, merge.GetExtensions())
+	mergedKeys, mergedGroups := group(s.MergedPackage, merged.GetExtensions())
+
+	outKeys := map[string]bool{}
+
+	first := true
+	for _, key := range baseKeys {
+		baseE := baseGroups[key]
+		mergeE, ok := mergeGroups[key]
+		if !ok {
+			mergeE = &Extension{Extendee: baseE.Extendee}
+		}
+		mergedE, ok := mergedGroups[key]
+		if !ok {
+			mergedE = &Extension{}
+		}
+
+		outE := s.mergeExtension(scope, baseE, mergeE, mergedE)
+
+		if first {
+			first = false
+			s.addBanner(&outE.Comments, "Extensions", "base")
+		}
+
+		out = append(out, outE)
+		outKeys[key] = true
+	}
+
+	first = true
+	for _, key := range mergeKeys {
+		if outKeys[key] {
+			continue
+		}
+		mergedE, ok := mergedGroups[key]
+		if !ok {
+			mergedE = &Extension{}
+		}
+
+		outE := s.mergeExtension(scope, &Extension{}, mergeGroups[key], mergedE)
+
+		if first {
+			first = false
+			s.addBanner(&outE.Comments, "Extensions", "merge")
+		}
+
+		out = append(out, outE)
+		outKeys[key] = true
+	}
+
+	// Nothing extends these anymore, they are only reported
+	for _, key := range mergedKeys {
+		if outKeys[key] {
+			continue
+		}
+		s.mergeExtension(scope, &Extension{}, &Extension{}, mergedGroups[key])
+	}
+
+	return out
+}
+
+// mergeExtension merges the fields of one extendee. Numbers are taken from
+// the previous output, then from the layers, since extension numbers live in
+// the extendee's number space and are usually chosen with care. They are
+// never renumbered, two extensions with the same number are an error.
+func (s *merger) mergeExtension(scope string, base, merge, merged *Extension) *Extension {
+	out := &Extension{
+		Comments: s.mergeComments(base.Comments, merge.Comments),
+		Extendee: s.rewriteType(merge.Extendee),
 	}
-	if len(merge.LeadingComments) > 0 {
-		out.LeadingComments = merge.LeadingComments
+
+	numberer := newFieldNumberer()
+	for _, f := range merged.Fields {
+		numberer.use(f.Name, f.Number)
+	}
+
+	owner := func(number int32) string {
+		for _, fields := range [][]*Field{out.Fields, merged.Fields} {
+			for _, f := range fields {
+				if f.Number == number {
+					return f.Name
+				}
+			}
+		}
+		return ""
+	}
+
+	add := func(origin Origin, baseF, mergeF *Field, number int32) {
+		pinned := numberer.pinned(baseF.Name)
+		if !pinned && numberer.taken.contains(number) {
+			s.errorf("extension %s of %s uses the number %d of extension %s", scopedName(scope, baseF.Name), out.Extendee, number, owner(number))
+		}
+		if !pinned {
+			numberer.use(baseF.Name, number)
+		}
+		outF, entry := s.mergeField(scope, origin, baseF, mergeF, numberer)
+		entry.Kind = KindExtension
+		if !pinned {
+			entry.Numbering = NumberAllocated
+		}
+		out.Fields = append(out.Fields, outF)
+	}
+
+	mergeMap := map[string]*Field{}
+	for _, f := range merge.Fields {
+		mergeMap[f.Name] = f
+	}
+
+	outMap := map[string]bool{}
+	for _, baseF := range base.Fields {
+		mergeF, ok := mergeMap[baseF.Name]
+		origin := OriginBoth
+		if !ok {
+			origin = OriginBase
+			mergeF = &Field{
+				Label: baseF.Label,
+				Key:   baseF.Key,
+				Type:  baseF.Type,
+				Name:  baseF.Name,
+			}
+		}
+		add(origin, baseF, mergeF, baseF.Number)
+		outMap[baseF.Name] = true
+	}
+	for _, mergeF := range merge.Fields {
+		if outMap[mergeF.Name] {
+			continue
+		}
+		baseF := &Field{
+			Label: mergeF.Label,
+			Key:   mergeF.Key,
+			Type:  mergeF.Type,
+			Name:  mergeF.Name,
+		}
+		add(OriginOverlay, baseF, mergeF, mergeF.Number)
+		outMap[mergeF.Name] = true
+	}
+
+	// Extensions can't be reserved, removing one is only reported
+	for _, f := range merged.Fields {
+		if outMap[f.Name] {
+			continue
+		}
+		s.report.add(&ReportEntry{
+			Kind:   KindExtension,
+			Path:   scopedName(scope, f.Name),
+			Number: ptr(f.Number),
+			Reason: fmt.Sprintf("extension %s was removed", f.Name),
+		})
+	}
+
+	return out
+}
+
+// buildPackages returns the package rules of the merge: the explicit ones,
+// then MergePackage's, then base's when base is carried along.
+func (s *merger) buildPackages() []PackageRule {
+	out := slices.Clone(s.Packages)
+	if s.MergePackage != "" {
+		out = append(out, PackageRule{From: s.MergePackage, To: s.MergedPackage})
+	}
+	from := s.BasePackage
+	if from == "" {
+		from = s.basePackage
+	}
+	if s.carriesBase() && from != "" && s.MergedPackage != "" {
+		out = append(out, PackageRule{From: from, To: s.MergedPackage})
+	}
+	return out
+}
+
+// rewritePackage rewrites a package, or a fully qualified name without the
+// leading dot, by the first package rule that matches.
+func (s *merger) rewritePackage(name string) string {
+	for _, r := range s.packages {
+		if out, ok := r.rewrite(name); ok {
+			return out
+		}
+	}
+	return name
+}
+
+// rewriteType points a fully qualified type at the package it's merged into.
+func (s *merger) rewriteType(t string) string {
+	if !strings.HasPrefix(t, ".") {
+		return t
+	}
+	return "." + s.rewritePackage(t[1:])
+}
+
+// optionName matches type URLs, "type.googleapis.com/acme.api.Foo", and
+// extension names, "[acme.api.ext]" or "(acme.api.ext)", in options.
+var optionName = regexp.MustCompile(`(\[?type\.googleapis\.com/|\[|\()([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)`)
+
+// rewriteOption rewrites the custom option names and the type URLs in an
+// option's name or value.
+func (s *merger) rewriteOption(text string) string {
+	return optionName.ReplaceAllStringFunc(text, func(match string) string {
+		parts := optionName.FindStringSubmatch(match)
+		return parts[1] + s.rewritePackage(parts[2])
+	})
+}
+
+// rewriteImport points an import of an overlay file, or of a base file when
+// base is carried along, at the merged tree. Imports no mapping names are
+// rewritten by the package rules, as directories, if they end up at one of
+// the Outputs.
+func (s *merger) rewriteImport(name string) string {
+	for _, m := range s.mappings {
+		if out, ok := m.Output(name); ok {
+			return out
+		}
+	}
+	for _, r := range s.packages {
+		if out, ok := r.rewriteDir(name); ok && s.Outputs[out] {
+			return out
+		}
 	}
-	if len(merge.TrailingComments) > 0 {
-		out.TrailingComments = merge.TrailingComments
+	return name
+}
+
+func (s *merger) buildMappings() []*Mapping {
+	out := slices.Clone(s.Mappings)
+	if s.MergePrefix == "" && s.BasePrefix == "" {
+		return out
+	}
+	m, err := PrefixMapping(s.BasePrefix, s.MergePrefix, s.MergedPrefix)
+	if err != nil {
+		// Without a merged prefix imports have nowhere to go
+		return out
 	}
+	return append(out, m)
+}
 
-	out.Fields = s.mergeFields(base, merge, numberer, reservedNames)
+// carriesBase reports whether base files are carried into the output tree,
+// so that references to them are rewritten too.
+func (s *merger) carriesBase() bool {
+	if s.BasePrefix != "" {
+		return true
+	}
+	for _, m := range s.Mappings {
+		if m.Base != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sameType reports whether a base and an overlay type are the same type in
+// the output. Base's own package stands for the merged package even when
+// base isn't carried along.
+func (s *merger) sameType(base, merge string) bool {
+	out := s.rewriteType(merge)
+	if s.rewriteType(base) == out {
+		return true
+	}
+	own := PackageRule{From: s.basePackage, To: s.rewritePackage(s.mergePackage)}
+	rebased, ok := own.rewrite(strings.TrimPrefix(base, "."))
+	return ok && "."+rebased == out
+}
+
+// localType strips the package pkg from a fully qualified type name so that
+// the same type can be compared across layers.
+func (s *merger) localType(pkg, t string) string {
+	return strings.TrimPrefix(t, fmt.Sprintf(".%s.", pkg))
+}
+
+func (s *merger) mergeOneof(scope string, base, merge *Oneof, fields *messageFields) *Oneof {
+	out := &Oneof{
+		Comments: s.mergeComments(base.Comments, merge.Comments),
+		Name:     base.Name,
+		Options:  s.mergeOptions(scopedName(scope, base.Name), base.Options, merge.Options),
+	}
+
+	out.Fields = s.mergeFields(scope, base.Name, base, merge, fields)
 
 	return out
 }
+
+func scopedName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,1006 @@
+package merge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/maxmzkr/protoc_merge/internal/diff"
+)
+
+// about returns the comments the example files put on every element.
+func about(name, layer string) Comments {
+	return Comments{
+		LeadingDetachedComments: []string{fmt.Sprintf(" A detached comment about %s in %s\n", name, layer)},
+		LeadingComments:         fmt.Sprintf(" A comment about %s in %s\n", name, layer),
+		TrailingComments:        fmt.Sprintf(" A trailing comment about %s in %s\n", name, layer),
+	}
+}
+
+// mustMerge merges the layers and fails the test on conflicts.
+func mustMerge(t *testing.T, spec *MergeSpec, base, merge, merged *File) (*File, *Report) {
+	t.Helper()
+	out, report, err := spec.MergeFile(base, merge, merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, report
+}
+
+// The examples share base's go_package, the merged file gets its own
+var exampleTemplates = map[string]*template.Template{
+	"go_package": template.Must(ParseOptionTemplate("go_package", "github.com/maxmzkr/protoc_merge/{{.OutputDir}}")),
+}
+
+const exampleOutput = "example/merged/test.proto"
+
+// exampleBase mirrors example/step1/base/test.proto
+func exampleBase() *File {
+	return &File{
+		Syntax:  &Syntax{Comments: about("syntax", "base"), Name: "proto3"},
+		Package: &Package{Comments: about("package", "base"), Name: "base"},
+		Options: []*Option{
+			{Name: "go_package", Value: `"github.com/maxmzkr/protoc_merge/example/base"`},
+		},
+		Dependencies: []*Dependency{
+			{Comments: about("import", "base"), Name: "google/protobuf/wrappers.proto"},
+			{Name: "options.proto"},
+		},
+		Enums: []*Enum{
+			{
+				Comments: about("TestEnum", "base"),
+				Name:     "TestEnum",
+				Values: []*EnumValue{
+					{Comments: about("BASE_UNIQUE_ENUM_VALUE", "base"), Name: "BASE_UNIQUE_ENUM_VALUE", Number: 0},
+					{Comments: about("BASE_REMOVED_ENUM_VALUE", "base"), Name: "BASE_REMOVED_ENUM_VALUE", Number: 1},
+				},
+			},
+		},
+		Messages: []*Message{
+			{
+				Comments: about("Test", "base"),
+				Name:     "Test",
+				Fields: []*Field{
+					{Comments: about("type_changed_from_int32_to_string", "base"), Name: "type_changed_from_int32_to_string", Number: 1, Type: "int32"},
+					{Comments: about("unique_to_base", "base"), Name: "unique_to_base", Number: 2, Type: "int32"},
+					{Comments: about("test_enum", "base"), Name: "test_enum", Number: 3, Type: ".base.TestEnum"},
+					{Comments: about("removed_by_reserved_name", "base"), Name: "removed_by_reserved_name", Number: 6, Type: "int32"},
+					{Name: "removed_by_base", Number: 7, Type: "int32"},
+				},
+				Oneofs: []*Oneof{
+					{
+						Comments: about("test_oneof", "base"),
+						Name:     "test_oneof",
+						Fields: []*Field{
+							{Comments: about("oneof_type_changed_from_int32_to_string", "base"), Name: "oneof_type_changed_from_int32_to_string", Number: 4, Type: "int32"},
+							{Comments: about("oneof_unique_to_base", "base"), Name: "oneof_unique_to_base", Number: 5, Type: ".google.protobuf.StringValue"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// exampleMerge mirrors example/step1/merge/test.proto
+func exampleMerge() *File {
+	return &File{
+		Syntax:  &Syntax{Comments: about("syntax", "merge"), Name: "proto3"},
+		Package: &Package{Comments: about("package", "merge"), Name: "merge"},
+		Options: []*Option{
+			{Name: "go_package", Value: `"github.com/maxmzkr/protoc_merge/example/base"`},
+		},
+		Dependencies: []*Dependency{
+			{Comments: about("import", "merge"), Name: "google/protobuf/wrappers.proto"},
+		},
+		Enums: []*Enum{
+			{
+				Comments: about("TestEnum", "merge"),
+				Name:     "TestEnum",
+				Values: []*EnumValue{
+					{Comments: about("MERGE_UNIQUE_ENUM_VALUE", "merge"), Name: "MERGE_UNIQUE_ENUM_VALUE", Number: 0},
+					{Comments: about("MERGE_REMOVED_ENUM_VALUE", "merge"), Name: "MERGE_REMOVED_ENUM_VALUE", Number: 1},
+				},
+			},
+		},
+		Messages: []*Message{
+			{
+				Comments: about("Test", "merge"),
+				Name:     "Test",
+				Fields: []*Field{
+					{Comments: about("type_changed_from_int32_to_string", "merge"), Name: "type_changed_from_int32_to_string", Number: 1, Type: "string"},
+					{Comments: about("unique_to_merge", "merge"), Name: "unique_to_merge", Number: 2, Type: "int32"},
+					{Comments: about("test_enum", "merge"), Name: "test_enum", Number: 3, Type: ".merge.TestEnum"},
+					{Name: "removed_by_merge", Number: 6, Type: "int32"},
+				},
+				Oneofs: []*Oneof{
+					{
+						Comments: about("test_oneof", "merge"),
+						Name:     "test_oneof",
+						Fields: []*Field{
+							{Comments: about("oneof_type_changed_from_int32_to_string", "merge"), Name: "oneof_type_changed_from_int32_to_string", Number: 4, Type: "string"},
+							{Comments: about("oneof_unique_to_merge", "merge"), Name: "oneof_unique_to_merge", Number: 5, Type: ".google.protobuf.StringValue"},
+						},
+					},
+				},
+				ReservedNames: []*ReservedName{
+					{Comments: about("removed_by_reserved_name", "merge"), Name: "removed_by_reserved_name"},
+				},
+			},
+		},
+	}
+}
+
+// reparse writes f out and parses it back, like the next run sees the
+// previous output.
+func reparse(t *testing.T, f *File) *File {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "test.proto"), []byte(Serialize(f)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseSource([]string{dir}, "test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0]
+}
+
+// forEachStyle runs test with a spec for every comment policy and anchor.
+func forEachStyle(t *testing.T, test func(t *testing.T, spec *MergeSpec)) {
+	policies := []CommentPolicy{CommentsConcat, CommentsDedupe, CommentsOverlay, CommentsBase, CommentsAnnotate}
+	for _, policy := range policies {
+		for _, anchor := range []Anchor{AnchorEnd, AnchorAfter} {
+			policy, anchor := policy, anchor
+			t.Run(fmt.Sprintf("%s/%s", policy, anchor), func(t *testing.T) {
+				test(t, &MergeSpec{
+					MergePackage:    "merge",
+					MergedPackage:   "merged",
+					CommentPolicy:   policy,
+					Anchor:          anchor,
+					Banner:          DefaultBanner,
+					OptionTemplates: exampleTemplates,
+					OutputFile:      exampleOutput,
+				})
+			})
+		}
+	}
+}
+
+func TestMergeIsIdempotent(t *testing.T) {
+	forEachStyle(t, func(t *testing.T, spec *MergeSpec) {
+		// The same inputs are reused on purpose, merging must not modify them
+		base := exampleBase()
+		merge := exampleMerge()
+
+		first, _ := mustMerge(t, spec, base, merge, &File{})
+		want := Serialize(first)
+		got := want
+		for run := 2; run <= 3; run++ {
+			out, _ := mustMerge(t, spec, base, merge, reparse(t, first))
+			if got = Serialize(out); got != want {
+				t.Fatalf("run %d differs from the first run:\n%s", run, diff.Unified("first", fmt.Sprintf("run %d", run), want, got))
+			}
+			first = out
+		}
+	})
+}
+
+func TestMergeIsIdempotentAfterRemovals(t *testing.T) {
+	forEachStyle(t, func(t *testing.T, spec *MergeSpec) {
+		// Produce a previous output with the full overlay, then drop fields
+		// and enum values so that the following runs have to reserve them
+		previous, _ := mustMerge(t, spec, exampleBase(), exampleMerge(), &File{})
+
+		base := exampleBase()
+		base.Messages[0].Fields = base.Messages[0].Fields[:4]
+		base.Enums[0].Values = base.Enums[0].Values[:1]
+		merge := exampleMerge()
+		merge.Messages[0].Fields = merge.Messages[0].Fields[:3]
+		merge.Enums[0].Values = merge.Enums[0].Values[:1]
+
+		first, _ := mustMerge(t, spec, base, merge, reparse(t, previous))
+		want := Serialize(first)
+		second, _ := mustMerge(t, spec, base, merge, reparse(t, first))
+		if got := Serialize(second); got != want {
+			t.Fatalf("second run differs from the first run:\n%s", diff.Unified("first", "second", want, got))
+		}
+	})
+}
+
+func TestMergeMessageOptions(t *testing.T) {
+	spec := &MergeSpec{
+		MergePackage:    "merge",
+		MergedPackage:   "merged",
+		OptionTemplates: exampleTemplates,
+		OutputFile:      exampleOutput,
+	}
+
+	base := exampleBase()
+	base.Messages[0].Options = []*Option{
+		{Name: "deprecated", Value: "true"},
+		{Name: "(options.string_option)", Value: `"base"`},
+	}
+	merge := exampleMerge()
+	merge.Messages[0].Options = []*Option{
+		{Name: "(options.string_option)", Value: `"merge"`},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	got := Serialize(out)
+	for _, want := range []string{
+		"  option deprecated = true;\n",
+		"  option (options.string_option) = \"merge\";\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output is missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, `"base"`) {
+		t.Errorf("the base value of an overridden option was kept:\n%s", got)
+	}
+}
+
+func TestMergeEnumAliases(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Enums: []*Enum{{
+			Name:    "Status",
+			Options: []*Option{{Name: "allow_alias", Value: "true"}},
+			Values: []*EnumValue{
+				{Name: "STATUS_UNKNOWN", Number: 0},
+				{Name: "STATUS_DONE", Number: 1},
+				{Name: "STATUS_FINISHED", Number: 1, Options: []*Option{{Name: "deprecated", Value: "true"}}},
+			},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+		Enums: []*Enum{{
+			Name: "Status",
+			Values: []*EnumValue{
+				{Name: "STATUS_FAILED", Number: 2},
+				{Name: "STATUS_ERROR", Number: 2},
+			},
+		}},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	got := Serialize(out)
+	for _, want := range []string{
+		"  option allow_alias = true;\n",
+		"  STATUS_DONE = 1;\n",
+		"  STATUS_FINISHED = 1 [deprecated = true];\n",
+		"  STATUS_FAILED = 2;\n",
+		"  STATUS_ERROR = 2;\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output is missing %q:\n%s", want, got)
+		}
+	}
+
+	// Removing the alias keeps its number in use, only the name is reserved
+	base.Enums[0].Values = base.Enums[0].Values[:2]
+	again, _ := mustMerge(t, spec, base, merge, out)
+	got = Serialize(again)
+	if !strings.Contains(got, "reserved \"STATUS_FINISHED\";") {
+		t.Errorf("the removed alias isn't reserved:\n%s", got)
+	}
+	if strings.Contains(got, "reserved 1;") {
+		t.Errorf("the number of the removed alias is reserved while in use:\n%s", got)
+	}
+
+	// Removing the last name of the number reserves it, once
+	base.Enums[0].Values = base.Enums[0].Values[:1]
+	again, _ = mustMerge(t, spec, base, merge, again)
+	got = Serialize(again)
+	if !strings.Contains(got, "  reserved 1;\n") {
+		t.Errorf("the number of the removed aliases isn't reserved:\n%s", got)
+	}
+	reservations := 0
+	for _, r := range again.Enums[0].ReservedRanges {
+		if r.Start <= 1 && 1 <= r.End {
+			reservations++
+		}
+	}
+	if reservations != 1 {
+		t.Errorf("got %d reservations of 1, want 1:\n%s", reservations, got)
+	}
+}
+
+func TestMergeMovesFieldsBetweenOneofs(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "a", Type: "int32", Number: 1}, {Name: "b", Type: "string", Number: 2}},
+			Oneofs: []*Oneof{{Name: "old", Fields: []*Field{{Name: "c", Type: "int32", Number: 3}}}},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "c", Type: "int32", Number: 3}},
+			Oneofs: []*Oneof{{Name: "choice", Fields: []*Field{{Name: "a", Type: "int32", Number: 1}}}},
+		}},
+	}
+	merged := &File{
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "a", Number: 1}, {Name: "b", Number: 2}},
+			Oneofs: []*Oneof{{Name: "old", Fields: []*Field{{Name: "c", Number: 3}}}},
+		}},
+	}
+
+	out, report := mustMerge(t, spec, base, merge, merged)
+	m := out.Messages[0]
+
+	names := func(fields []*Field) []string {
+		out := []string{}
+		for _, f := range fields {
+			out = append(out, fmt.Sprintf("%s=%d", f.Name, f.Number))
+		}
+		return out
+	}
+	if got := names(m.Fields); !slices.Equal(got, []string{"b=2", "c=3"}) {
+		t.Errorf("got fields %v, want [b=2 c=3]", got)
+	}
+	// old lost its only field, so it's dropped
+	if len(m.Oneofs) != 1 || m.Oneofs[0].Name != "choice" {
+		t.Fatalf("got oneofs %v, want only choice", m.Oneofs)
+	}
+	if got := names(m.Oneofs[0].Fields); !slices.Equal(got, []string{"a=1"}) {
+		t.Errorf("got oneof fields %v, want [a=1]", got)
+	}
+
+	moves := map[string]*ReportEntry{}
+	for _, e := range report.Entries {
+		if e.OneofChanged {
+			moves[e.Path] = e
+		}
+	}
+	if e := moves["M.a"]; e == nil || e.BaseOneof != "" || e.Oneof != "choice" {
+		t.Errorf("got move %+v for M.a, want from a plain field to choice", e)
+	}
+	if e := moves["M.c"]; e == nil || e.BaseOneof != "old" || e.Oneof != "" {
+		t.Errorf("got move %+v for M.c, want from old to a plain field", e)
+	}
+	if len(moves) != 2 {
+		t.Errorf("got %d moves, want 2", len(moves))
+	}
+}
+
+func TestMergeExtensionRanges(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	declaration := &Option{Name: "declaration", Value: `{ number: 5, full_name: ".merge.ext", type: "int32" }`}
+	base := &File{
+		Syntax:  &Syntax{Name: "proto2"},
+		Package: &Package{Name: "base"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "a", Type: "int32", Number: 1}},
+			ExtensionRanges: []*ExtensionRange{
+				{Start: 2, End: 4},
+				{Start: 100, End: maxFieldNumber},
+			},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto2"},
+		Package: &Package{Name: "merge"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "b", Type: "int32", Number: 2}},
+			ExtensionRanges: []*ExtensionRange{
+				{Start: 5, End: 9, Options: []*Option{declaration}},
+			},
+			ReservedRanges: []*ReservedRange{{Start: 200, End: 300}},
+		}},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	m := out.Messages[0]
+
+	got := []string{}
+	for _, r := range m.ExtensionRanges {
+		got = append(got, formatRange(r.Start, r.End, maxFieldNumber))
+	}
+	if want := []string{"2 to 9", "100 to 199", "301 to max"}; !slices.Equal(got, want) {
+		t.Errorf("got extension ranges %v, want %v", got, want)
+	}
+	if len(m.ExtensionRanges[0].Options) != 1 {
+		t.Errorf("got options %v, want the declaration of the overlay", m.ExtensionRanges[0].Options)
+	}
+	// 2 to 9 are extension numbers
+	if b := m.Fields[1]; b.Number != 10 {
+		t.Errorf("got b = %d, want 10", b.Number)
+	}
+
+	text := Serialize(out)
+	for _, want := range []string{
+		"  extensions 2 to 9 [declaration = { number: 5, full_name: \".merge.ext\", type: \"int32\" }];\n",
+		"  extensions 301 to max;\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("output is missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestMergeSkipsImplementationNumbers(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+	message := func(pkg string, fields ...*Field) *File {
+		return &File{
+			Syntax:  &Syntax{Name: "proto2"},
+			Package: &Package{Name: pkg},
+			Messages: []*Message{{
+				Name:            "M",
+				Fields:          fields,
+				ExtensionRanges: []*ExtensionRange{{Start: 2, End: 18999}},
+			}},
+		}
+	}
+	a := &Field{Label: "optional", Name: "a", Type: "int32", Number: 1}
+	b := &Field{Label: "optional", Name: "b", Type: "int32", Number: 2}
+
+	out, _ := mustMerge(t, spec, message("base", a), message("merge", a, b), &File{})
+	if got := out.Messages[0].Fields[1].Number; got != 20000 {
+		t.Errorf("got b = %d, want 20000 past the numbers protobuf reserves", got)
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	ranges := coalesceRanges([]*ReservedRange{
+		{Start: 10, End: 20},
+		{Start: 4, End: 4, Comments: Comments{LeadingComments: " four\n"}},
+		{Start: 5, End: 5, Comments: Comments{LeadingComments: " five\n"}},
+		{Start: 15, End: maxFieldNumber},
+		{Start: 7, End: 7},
+	})
+
+	got := []string{}
+	for _, r := range ranges {
+		got = append(got, formatRange(r.Start, r.End, maxFieldNumber))
+	}
+	if want := []string{"4 to 5", "7", "10 to max"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := ranges[0].LeadingComments; got != " four\n five\n" {
+		t.Errorf("got comments %q, want both", got)
+	}
+}
+
+func TestMergeOrder(t *testing.T) {
+	field := func(name string, line int32, comment string) *Field {
+		return &Field{
+			Comments: Comments{LeadingComments: comment},
+			Position: Position{Line: line},
+			Name:     name,
+			Type:     "int32",
+		}
+	}
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{field("a", 1, ""), field("c", 3, "")},
+			Oneofs: []*Oneof{{Position: Position{Line: 2}, Name: "b", Fields: []*Field{field("b1", 0, "")}}},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				field("a", 1, ""),
+				field("x", 2, ""),
+				field("c", 3, ""),
+				field("y", 4, " @merge first\n"),
+				field("z", 5, " Placed explicitly\n @merge after b\n"),
+			},
+		}},
+	}
+
+	for _, test := range []struct {
+		anchor Anchor
+		want   []string
+	}{
+		{AnchorEnd, []string{"y", "a", "b", "z", "c", "x"}},
+		{AnchorAfter, []string{"y", "a", "x", "b", "z", "c"}},
+	} {
+		t.Run(string(test.anchor), func(t *testing.T) {
+			spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged", Anchor: test.anchor}
+			out, _ := mustMerge(t, spec, base, merge, &File{})
+
+			elements := (&merger{MergeSpec: spec}).messageElements(out.Messages[0])
+			slices.SortFunc(elements, func(a, b element) int {
+				return a.position.compare(*b.position)
+			})
+			got := []string{}
+			for _, e := range elements {
+				got = append(got, e.name)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got order %v, want %v", got, test.want)
+			}
+
+			text := Serialize(out)
+			if strings.Contains(text, "@merge") {
+				t.Errorf("a directive was written:\n%s", text)
+			}
+			if !strings.Contains(text, "  // Placed explicitly\n  int32 z") {
+				t.Errorf("the comment around the directive was lost:\n%s", text)
+			}
+		})
+	}
+}
+
+func TestMergeCarriesBaseReserved(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Messages: []*Message{{
+			Name:           "M",
+			Fields:         []*Field{{Name: "a", Type: "int32", Number: 1}},
+			ReservedRanges: []*ReservedRange{{Comments: Comments{LeadingComments: " retired\n"}, Start: 2, End: 3}},
+			ReservedNames:  []*ReservedName{{Name: "old"}},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "b", Type: "int32", Number: 5}},
+		}},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	m := out.Messages[0]
+	if got := m.Fields[1]; got.Name != "b" || got.Number != 4 {
+		t.Errorf("got %s = %d, want b = 4 after the reserved range", got.Name, got.Number)
+	}
+	text := Serialize(out)
+	for _, want := range []string{"  // retired\n  reserved 2 to 3;\n", "  reserved \"old\";\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("output is missing %q:\n%s", want, text)
+		}
+	}
+
+	// The range is in the previous output too now, its comment isn't
+	// repeated
+	again, _ := mustMerge(t, spec, base, merge, out)
+	if got := Serialize(again); got != text {
+		t.Errorf("merging the output again changed it:\n%s", diff.Unified("first", "again", text, got))
+	}
+
+	merge.Messages[0].Fields = append(merge.Messages[0].Fields,
+		&Field{Name: "old", Type: "int32", Number: 6},
+		&Field{Name: "c", Type: "int32", Number: 3},
+	)
+	_, _, err := spec.MergeFile(base, merge, &File{})
+	if err == nil {
+		t.Fatal("got no error for overlay fields that use reserved names and numbers")
+	}
+	for _, want := range []string{"field old uses a name reserved in base", "field c uses the number 3 reserved in base"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	spec := &MergeSpec{
+		MergePackage:  "merge",
+		MergedPackage: "merged",
+		BasePrefix:    "base/",
+		MergePrefix:   "merge/",
+		MergedPrefix:  "merged/",
+	}
+
+	base := &File{
+		Syntax:       &Syntax{Name: "proto3"},
+		Package:      &Package{Name: "base"},
+		Dependencies: []*Dependency{{Name: "base/other.proto"}, {Name: "google/protobuf/wrappers.proto"}},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				{Name: "a", Type: ".base.Other", Number: 7},
+				{Name: "b", Type: ".google.protobuf.Int32Value", Number: 2},
+			},
+		}},
+		Enums: []*Enum{{
+			Name:   "E",
+			Values: []*EnumValue{{Name: "E_UNSPECIFIED", Number: 0}, {Name: "E_A", Number: 5}},
+		}},
+	}
+
+	out, report, err := spec.PassThrough(base, OriginBase, &File{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Package.Name != "merged" {
+		t.Errorf("got package %s, want merged", out.Package.Name)
+	}
+	if got := out.Dependencies[0].Name; got != "merged/other.proto" {
+		t.Errorf("got import %s, want merged/other.proto", got)
+	}
+	if got := out.Dependencies[1].Name; got != "google/protobuf/wrappers.proto" {
+		t.Errorf("got import %s, want it unchanged", got)
+	}
+	m := out.Messages[0]
+	if got := m.Fields[0]; got.Type != ".merged.Other" || got.Number != 7 {
+		t.Errorf("got %s %s = %d, want .merged.Other a = 7", got.Type, got.Name, got.Number)
+	}
+	if got := m.Fields[1]; got.Type != ".google.protobuf.Int32Value" || got.Number != 2 {
+		t.Errorf("got %s %s = %d, want .google.protobuf.Int32Value b = 2", got.Type, got.Name, got.Number)
+	}
+	if got := out.Enums[0].Values[1].Number; got != 5 {
+		t.Errorf("got E_A = %d, want 5", got)
+	}
+	for _, e := range report.Entries {
+		if e.Origin != "" && e.Origin != OriginBase {
+			t.Errorf("%s has origin %s, want base", e.Path, e.Origin)
+		}
+	}
+
+	// The overlay's own files come through the same way
+	overlay := &File{
+		Syntax:       &Syntax{Name: "proto3"},
+		Package:      &Package{Name: "merge"},
+		Dependencies: []*Dependency{{Name: "merge/extra.proto"}},
+		Messages: []*Message{{
+			Name:   "N",
+			Fields: []*Field{{Name: "c", Type: ".merge.Extra", Number: 3}},
+		}},
+	}
+	out, _, err = spec.PassThrough(overlay, OriginOverlay, &File{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Dependencies[0].Name; got != "merged/extra.proto" {
+		t.Errorf("got import %s, want merged/extra.proto", got)
+	}
+	if got := out.Messages[0].Fields[0]; got.Type != ".merged.Extra" || got.Number != 3 {
+		t.Errorf("got %s %s = %d, want .merged.Extra c = 3", got.Type, got.Name, got.Number)
+	}
+}
+
+func TestBasePackageSpansPackages(t *testing.T) {
+	spec := &MergeSpec{
+		BasePackage:   "b",
+		MergePackage:  "o",
+		MergedPackage: "out",
+		BasePrefix:    "base/",
+		MergePrefix:   "merge/",
+		MergedPrefix:  "merged/",
+	}
+
+	common := &File{
+		Syntax:   &Syntax{Name: "proto3"},
+		Package:  &Package{Name: "b.common"},
+		Messages: []*Message{{Name: "Shared"}},
+	}
+	out, _, err := spec.PassThrough(common, OriginBase, &File{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Package.Name != "out.common" {
+		t.Errorf("got package %s, want out.common", out.Package.Name)
+	}
+
+	// References from base's other packages agree with it
+	api := &File{
+		Syntax:       &Syntax{Name: "proto3"},
+		Package:      &Package{Name: "b"},
+		Dependencies: []*Dependency{{Name: "base/common.proto"}},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "shared", Type: ".b.common.Shared", Number: 1}},
+		}},
+	}
+	out, _, err = spec.PassThrough(api, OriginBase, &File{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Package.Name != "out" {
+		t.Errorf("got package %s, want out", out.Package.Name)
+	}
+	if got := out.Messages[0].Fields[0].Type; got != ".out.common.Shared" {
+		t.Errorf("got type %s, want .out.common.Shared", got)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	merged := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merged"},
+		Messages: []*Message{{
+			Name:           "M",
+			Fields:         []*Field{{Name: "a", Type: "int32", Number: 1}, {Name: "b", Type: "int32", Number: 4}},
+			ReservedRanges: []*ReservedRange{{Start: 2, End: 2}},
+		}},
+		Enums: []*Enum{{
+			Name:   "E",
+			Values: []*EnumValue{{Name: "E_UNSPECIFIED", Number: 0}, {Name: "E_A", Number: 5}},
+		}},
+	}
+
+	out, _, err := spec.Tombstone(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := out.Messages[0]
+	if len(m.Fields) != 0 {
+		t.Errorf("got %d fields, want none", len(m.Fields))
+	}
+	if got := len(m.ReservedRanges); got != 2 || m.ReservedRanges[0].Start != 1 || m.ReservedRanges[0].End != 2 || m.ReservedRanges[1].Start != 4 {
+		t.Errorf("got reserved ranges %v, want 1 to 2 and 4", m.ReservedRanges)
+	}
+	if got := len(m.ReservedNames); got != 2 {
+		t.Errorf("got %d reserved names, want a and b", got)
+	}
+	e := out.Enums[0]
+	if len(e.Values) != 1 || e.Values[0].Name != "E_UNSPECIFIED" {
+		t.Errorf("got values %v, want only E_UNSPECIFIED", e.Values)
+	}
+	if len(e.ReservedRanges) != 1 || e.ReservedRanges[0].Start != 5 {
+		t.Errorf("got reserved ranges %v, want 5", e.ReservedRanges)
+	}
+
+	text := Serialize(out)
+	again, _, err := spec.Tombstone(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Serialize(again); got != text {
+		t.Errorf("tombstoning the tombstone changed it:\n%s", diff.Unified("first", "again", text, got))
+	}
+}
+
+func TestMergePackageRules(t *testing.T) {
+	spec := &MergeSpec{
+		Packages: []PackageRule{
+			{From: "acme.ext.api", To: "acme.merged.api"},
+			{From: "acme.types", To: "acme.merged.types"},
+		},
+		Outputs: map[string]bool{"acme/merged/types/t.proto": true},
+	}
+
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "acme.api.v1"},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Name: "a", Type: "int32", Number: 1}},
+		}},
+	}
+	merge := &File{
+		Syntax:       &Syntax{Name: "proto3"},
+		Package:      &Package{Name: "acme.ext.api.v1"},
+		Dependencies: []*Dependency{{Name: "acme/types/t.proto"}, {Name: "acme/typesx/t.proto"}, {Name: "acme/types/vendored.proto"}},
+		Options: []*Option{
+			{Name: "(acme.types.meta)", Value: "{\n  [type.googleapis.com/acme.ext.api.v1.common.C]: {}\n}"},
+		},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				{Name: "a", Type: "int32", Number: 1},
+				{Name: "b", Type: ".acme.ext.api.v1.common.C", Number: 2},
+				{Name: "c", Type: ".acme.typesx.T", Number: 3},
+			},
+		}},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	if got := out.Package.Name; got != "acme.merged.api.v1" {
+		t.Errorf("got package %s, want acme.merged.api.v1", got)
+	}
+	fields := out.Messages[0].Fields
+	if got := fields[1].Type; got != ".acme.merged.api.v1.common.C" {
+		t.Errorf("got type %s, want the sub-package rewritten", got)
+	}
+	if got := fields[2].Type; got != ".acme.typesx.T" {
+		t.Errorf("got type %s, want acme.typesx left alone", got)
+	}
+	// vendored.proto isn't merged, so there is nothing to point it at
+	got := []string{}
+	for _, d := range out.Dependencies {
+		got = append(got, d.Name)
+	}
+	if want := []string{"acme/merged/types/t.proto", "acme/typesx/t.proto", "acme/types/vendored.proto"}; !slices.Equal(got, want) {
+		t.Errorf("got imports %v, want %v", got, want)
+	}
+	o := out.Options[0]
+	if o.Name != "(acme.merged.types.meta)" || !strings.Contains(o.Value, "[type.googleapis.com/acme.merged.api.v1.common.C]") {
+		t.Errorf("got option %s = %s, want its name and type URL rewritten", o.Name, o.Value)
+	}
+}
+
+func TestMergeOptionTemplates(t *testing.T) {
+	templates := map[string]*template.Template{}
+	for name, text := range map[string]string{
+		"go_package":   "example.com/{{.OutputDir}};{{.PackageLast}}pb",
+		"java_package": "{{.Value}}.merged",
+	} {
+		tmpl, err := ParseOptionTemplate(name, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templates[name] = tmpl
+	}
+	spec := &MergeSpec{
+		MergePackage:    "merge",
+		MergedPackage:   "acme.merged",
+		OptionTemplates: templates,
+		OutputFile:      "gen/acme/test.proto",
+	}
+
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Options: []*Option{
+			{Name: "go_package", Value: `"example.com/base"`},
+			{Name: "java_package", Value: `"com.acme"`},
+		},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+	}
+
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	got := map[string]string{}
+	for _, o := range out.Options {
+		got[o.Name] = o.Value
+	}
+	if want := `"example.com/gen/acme;mergedpb"`; got["go_package"] != want {
+		t.Errorf("got go_package %s, want %s", got["go_package"], want)
+	}
+	if want := `"com.acme.merged"`; got["java_package"] != want {
+		t.Errorf("got java_package %s, want %s", got["java_package"], want)
+	}
+
+	// Without a template the merged file would be compiled into base's
+	// Go package
+	spec.OptionTemplates = nil
+	_, _, err := spec.MergeFile(base, merge, &File{})
+	if err == nil || !strings.Contains(err.Error(), `go_package "example.com/base" is the same as base's`) {
+		t.Errorf("got error %v, want a go_package clash", err)
+	}
+
+	// Nor into the package of any other input file
+	spec.OptionTemplates = templates
+	spec.GoPackages = map[string]string{"example.com/gen/acme": "acme/other.proto"}
+	_, _, err = spec.MergeFile(base, merge, &File{})
+	if err == nil || !strings.Contains(err.Error(), `go_package "example.com/gen/acme" is the same as acme/other.proto's`) {
+		t.Errorf("got error %v, want a go_package clash with another input", err)
+	}
+}
+
+func TestMergeDiagnostics(t *testing.T) {
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "base"},
+		Options: []*Option{{Position: Position{Line: 3, Column: 1}, Name: "java_package", Value: `"com.base"`}},
+		Enums:   []*Enum{{Name: "E", Values: []*EnumValue{{Name: "E_UNSPECIFIED"}}}},
+		Messages: []*Message{{
+			Name:   "M",
+			Fields: []*Field{{Position: Position{Line: 6, Column: 3}, Name: "a", Type: "int32", Number: 1}},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "merge"},
+		Enums: []*Enum{{Name: "E", Values: []*EnumValue{
+			{Position: Position{Line: 4, Column: 3}, Name: "E_UNSPECIFIED"},
+			{Position: Position{Line: 5, Column: 3}, Name: "E_NEW", Number: 1},
+		}}},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				{Position: Position{Line: 8, Column: 3}, Name: "a", Type: "string", Number: 1},
+				{Position: Position{Line: 9, Column: 3}, Name: "b", Type: "string", Number: 2},
+			},
+		}},
+	}
+	merged := &File{
+		Enums:    []*Enum{{Name: "E", Values: []*EnumValue{{Name: "E_UNSPECIFIED"}}}},
+		Messages: []*Message{{Name: "M", Fields: []*Field{{Name: "a", Number: 1}}}},
+	}
+
+	for _, test := range []struct {
+		level Level
+		want  []string
+	}{
+		{LevelWarn, []string{
+			"8:3: warn: M.a: type changed from int32 to string",
+		}},
+		{LevelInfo, []string{
+			"5:3: info: E.E_NEW: allocated number 1",
+			"8:3: warn: M.a: type changed from int32 to string",
+			"9:3: info: M.b: allocated number 2",
+		}},
+		{LevelDebug, []string{
+			`3:1: debug: java_package: option set by base to "com.base"`,
+			"5:3: info: E.E_NEW: allocated number 1",
+			"8:3: warn: M.a: type changed from int32 to string",
+			"9:3: info: M.b: allocated number 2",
+		}},
+	} {
+		spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged", LogLevel: test.level}
+		_, report := mustMerge(t, spec, base, merge, merged)
+		got := []string{}
+		for _, d := range report.Diagnostics {
+			// Without a file the position isn't written
+			d.File = "f"
+			got = append(got, strings.TrimPrefix(d.String(), "f:"))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("got diagnostics %q at %s, want %q", got, test.level, test.want)
+		}
+	}
+}
+
+func TestMergeFieldTypeChanges(t *testing.T) {
+	spec := &MergeSpec{MergePackage: "m", MergedPackage: "out"}
+
+	field := func(name, typ string, number int32) *Field {
+		return &Field{Name: name, Type: typ, Number: number}
+	}
+	base := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "b"},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				field("shared", ".b.common.Shared", 1),
+				field("own", ".b.M", 2),
+				field("changed", ".b.common.Shared", 3),
+			},
+		}},
+	}
+	merge := &File{
+		Syntax:  &Syntax{Name: "proto3"},
+		Package: &Package{Name: "m"},
+		Messages: []*Message{{
+			Name: "M",
+			Fields: []*Field{
+				field("shared", ".b.common.Shared", 1),
+				field("own", ".m.M", 2),
+				field("changed", ".m.M", 3),
+			},
+		}},
+	}
+
+	_, report := mustMerge(t, spec, base, merge, &File{})
+	changed := []string{}
+	for _, e := range report.Entries {
+		if e.TypeChanged {
+			changed = append(changed, e.Path)
+		}
+	}
+	if !slices.Equal(changed, []string{"M.changed"}) {
+		t.Errorf("got type changes %v, want [M.changed]", changed)
+	}
+}
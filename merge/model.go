@@ -1,12 +1,15 @@
 package merge
 
+import "cmp"
+
 type File struct {
 	Syntax       *Syntax
 	Package      *Package
-	Options      []*FileOption
+	Options      []*Option
 	Dependencies []*Dependency
 	Enums        []*Enum
 	Messages     []*Message
+	Extensions   []*Extension
 }
 
 func (f *File) GetEnums() []*Enum {
@@ -17,70 +20,99 @@ func (f *File) GetMessages() []*Message {
 	return f.Messages
 }
 
-type FileOption struct {
+func (f *File) GetExtensions() []*Extension {
+	return f.Extensions
+}
+
+// Comments are the comments protoc attaches to an element.
+type Comments struct {
 	LeadingDetachedComments []string
 	LeadingComments         string
 	TrailingComments        string
-	Name                    string
-	Value                   string
+}
+
+// Position is where an element starts in its source file, 1-based. Elements
+// are written sorted by position, and the zero Position keeps the default
+// layout. The merge gives every element it outputs a position in the order
+// it should be written.
+type Position struct {
+	Line   int32 `json:"line,omitempty"`
+	Column int32 `json:"column,omitempty"`
+}
+
+func (p Position) compare(other Position) int {
+	if p.Line != other.Line {
+		return cmp.Compare(p.Line, other.Line)
+	}
+	return cmp.Compare(p.Column, other.Column)
+}
+
+// Option is an option statement, Value is written as a .proto literal.
+type Option struct {
+	Comments
+	Position
+	Name  string
+	Value string
 }
 
 type Syntax struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
+	Comments
+	Name string
 }
 
 type Package struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
+	Comments
+	Name string
 }
 
 type Dependency struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
+	Comments
+	Name string
 }
 
 type Enum struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
-	Values                  []*EnumValue
-	ReservedRanges          []*ReservedRange
-	ReservedNames           []*ReservedName
+	Comments
+	Position
+	Name           string
+	Options        []*Option
+	Values         []*EnumValue
+	ReservedRanges []*ReservedRange
+	ReservedNames  []*ReservedName
 }
 
 type EnumValue struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
-	Number                  int32
+	Comments
+	Position
+	Name   string
+	Number int32
+	// Options are written inline, e.g. [deprecated = true], so their
+	// comments are dropped
+	Options []*Option
 }
 
 type Message struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
-	Enums                   []*Enum
-	Messages                []*Message
-	Fields                  []*Field
-	Oneofs                  []*Oneof
-	ReservedRanges          []*ReservedRange
-	ReservedNames           []*ReservedName
+	Comments
+	Position
+	Name            string
+	Options         []*Option
+	Enums           []*Enum
+	Messages        []*Message
+	Fields          []*Field
+	Oneofs          []*Oneof
+	Extensions      []*Extension
+	ExtensionRanges []*ExtensionRange
+	ReservedRanges  []*ReservedRange
+	ReservedNames   []*ReservedName
 }
 
 func (m *Message) GetEnums() []*Enum {
 	return m.Enums
 }
 
+func (m *Message) GetExtensions() []*Extension {
+	return m.Extensions
+}
+
 func (m *Message) GetMessages() []*Message {
 	return m.Messages
 }
@@ -90,38 +122,56 @@ func (m *Message) GetFields() []*Field {
 }
 
 type Oneof struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
-	Fields                  []*Field
+	Comments
+	Position
+	Name    string
+	Options []*Option
+	Fields  []*Field
 }
 
 func (o *Oneof) GetFields() []*Field {
 	return o.Fields
 }
 
-type Field struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
-	Number                  int32
-	Label                   string
-	Type                    string
+// Extension is an extend block, Extendee is the fully qualified name of the
+// extended message.
+type Extension struct {
+	Comments
+	Position
+	Extendee string
+	Fields   []*Field
 }
 
+type Field struct {
+	Comments
+	Position
+	Name   string
+	Number int32
+	Label  string
+	// Key is the key type of a map field, Type is then the value type
+	Key  string
+	Type string
+}
+
+// ExtensionRange is an extensions statement, End is inclusive.
+type ExtensionRange struct {
+	Comments
+	Position
+	Start   int32
+	End     int32
+	Options []*Option
+}
+
+// ReservedRange is a range of a reserved statement, End is inclusive.
 type ReservedRange struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Start                   int32
-	End                     int32
+	Comments
+	Position
+	Start int32
+	End   int32
 }
 
 type ReservedName struct {
-	LeadingDetachedComments []string
-	LeadingComments         string
-	TrailingComments        string
-	Name                    string
+	Comments
+	Position
+	Name string
 }
@@ -0,0 +1,147 @@
+package merge
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// intervals is a set of numbers kept as sorted, inclusive intervals. Adjacent
+// and overlapping intervals are combined, so the number after an interval is
+// never in the set. Bounds are int64 so that the end of max + 1 doesn't
+// overflow.
+type intervals []interval
+
+type interval struct {
+	start, end int64
+}
+
+// find returns the index of the first interval that ends at or after number.
+func (s intervals) find(number int64) int {
+	return sort.Search(len(s), func(i int) bool { return s[i].end >= number })
+}
+
+func (s intervals) contains(number int32) bool {
+	i := s.find(int64(number))
+	return i < len(s) && s[i].start <= int64(number)
+}
+
+// add adds the numbers from start to end, inclusive.
+func (s *intervals) add(start, end int32) {
+	if start > end {
+		return
+	}
+	added := interval{int64(start), int64(end)}
+
+	// Every interval from i to j touches the added one
+	i := s.find(added.start - 1)
+	j := i
+	for j < len(*s) && (*s)[j].start <= added.end+1 {
+		added.start = min(added.start, (*s)[j].start)
+		added.end = max(added.end, (*s)[j].end)
+		j++
+	}
+
+	*s = slices.Replace(*s, i, j, added)
+}
+
+// firstFree returns the smallest number from number on that isn't in the set.
+func (s intervals) firstFree(number int32) int64 {
+	i := s.find(int64(number))
+	if i < len(s) && s[i].start <= int64(number) {
+		return s[i].end + 1
+	}
+	return int64(number)
+}
+
+// numberer hands out numbers to names. Numbers that are in use, reserved or
+// in extension ranges are never handed out again.
+type numberer struct {
+	reserved map[string]int32
+	// taken are the numbers in use and the excluded ranges
+	taken intervals
+	// start and max bound the numbers handed out
+	start, max int32
+	// hints are the numbers number hands out first, when they are free
+	hints map[string]int32
+}
+
+func newNumberer(start, max int32) *numberer {
+	return &numberer{
+		reserved: make(map[string]int32),
+		start:    start,
+		max:      max,
+		hints:    make(map[string]int32),
+	}
+}
+
+// Field numbers 19000 to 19999 are reserved for the protobuf implementation.
+const (
+	firstImplementationNumber = 19000
+	lastImplementationNumber  = 19999
+)
+
+// newFieldNumberer returns a numberer for fields, which never hands out the
+// numbers protobuf reserves for itself. Enum values have no such range.
+func newFieldNumberer() *numberer {
+	n := newNumberer(1, maxFieldNumber)
+	n.exclude(firstImplementationNumber, lastImplementationNumber)
+	return n
+}
+
+// exclude keeps the numbers from start to end, inclusive, from being handed
+// out.
+func (n *numberer) exclude(start, end int32) {
+	n.taken.add(start, end)
+}
+
+func (n *numberer) use(name string, number int32) {
+	n.reserved[name] = number
+	n.taken.add(number, number)
+}
+
+// pinned reports whether name already has a number, either from the
+// previous output or from an earlier call to number.
+func (n *numberer) pinned(name string) bool {
+	_, ok := n.reserved[name]
+	return ok
+}
+
+// alias gives name the number of target, unless name is already pinned.
+func (n *numberer) alias(name, target string) (int32, error) {
+	if number, ok := n.reserved[name]; ok {
+		return number, nil
+	}
+	number, err := n.number(target)
+	if err != nil {
+		return 0, err
+	}
+	n.reserved[name] = number
+	return number, nil
+}
+
+// hint asks for name to be given number, if it's still free by the time name
+// is numbered.
+func (n *numberer) hint(name string, number int32) {
+	n.hints[name] = number
+}
+
+// number returns the number of name, or gives it its hint or the smallest
+// free one. It fails when every number up to max is taken.
+func (n *numberer) number(name string) (int32, error) {
+	if number, ok := n.reserved[name]; ok {
+		return number, nil
+	}
+	if number, ok := n.hints[name]; ok && !n.taken.contains(number) {
+		n.use(name, number)
+		return number, nil
+	}
+
+	free := n.taken.firstFree(n.start)
+	if free > int64(n.max) {
+		return 0, fmt.Errorf("every number up to %d is taken", n.max)
+	}
+	number := int32(free)
+	n.use(name, number)
+	return number, nil
+}
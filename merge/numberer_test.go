@@ -0,0 +1,176 @@
+package merge
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// mapNumberer is the numberer as it was before it was interval based, with a
+// map entry per number. It is the reference for small inputs.
+type mapNumberer struct {
+	reserved map[string]int32
+	used     map[int32]bool
+	next     int32
+}
+
+func newMapNumberer(start int32) *mapNumberer {
+	return &mapNumberer{reserved: map[string]int32{}, used: map[int32]bool{}, next: start - 1}
+}
+
+func (n *mapNumberer) exclude(start, end int32) {
+	for i := start; i <= end; i++ {
+		n.used[i] = true
+	}
+}
+
+func (n *mapNumberer) use(name string, number int32) {
+	n.reserved[name] = number
+	n.used[number] = true
+}
+
+func (n *mapNumberer) number(name string) int32 {
+	if number, ok := n.reserved[name]; ok {
+		return number
+	}
+	for {
+		n.next++
+		if !n.used[n.next] {
+			break
+		}
+	}
+	n.use(name, n.next)
+	return n.next
+}
+
+func (n *mapNumberer) alias(name, target string) int32 {
+	if number, ok := n.reserved[name]; ok {
+		return number
+	}
+	number := n.number(target)
+	n.reserved[name] = number
+	return number
+}
+
+// must unwraps the number of a numberer that isn't expected to run out.
+func must(number int32, err error) int32 {
+	if err != nil {
+		panic(err)
+	}
+	return number
+}
+
+func TestNumbererMatchesMapNumberer(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < 2000; run++ {
+		start := int32(r.Intn(2))
+		got, want := newNumberer(start, maxFieldNumber), newMapNumberer(start)
+		name := func() string { return fmt.Sprintf("f%d", r.Intn(20)) }
+		small := func() int32 { return int32(r.Intn(40)) }
+
+		log := []string{}
+		for op := 0; op < 30; op++ {
+			var g, w int32
+			switch r.Intn(4) {
+			case 0:
+				a, b := small(), small()
+				log = append(log, fmt.Sprintf("exclude(%d, %d)", a, b))
+				got.exclude(a, b)
+				want.exclude(a, b)
+				continue
+			case 1:
+				n, number := name(), small()
+				log = append(log, fmt.Sprintf("use(%s, %d)", n, number))
+				got.use(n, number)
+				want.use(n, number)
+				continue
+			case 2:
+				n := name()
+				log = append(log, fmt.Sprintf("number(%s)", n))
+				g, w = must(got.number(n)), want.number(n)
+			case 3:
+				n, target := name(), name()
+				log = append(log, fmt.Sprintf("alias(%s, %s)", n, target))
+				g, w = must(got.alias(n, target)), want.alias(n, target)
+			}
+			if g != w {
+				t.Fatalf("got %d, want %d after\n%v", g, w, log)
+			}
+		}
+	}
+}
+
+func TestIntervalsAdd(t *testing.T) {
+	var s intervals
+	for _, r := range [][2]int32{{10, 20}, {1, 2}, {22, 30}, {21, 21}, {3, 5}, {40, maxFieldNumber}} {
+		s.add(r[0], r[1])
+	}
+	want := intervals{{1, 5}, {10, 30}, {40, maxFieldNumber}}
+	if fmt.Sprint(s) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+	if got := s.firstFree(12); got != 31 {
+		t.Errorf("got first free %d after 12, want 31", got)
+	}
+	if got := s.firstFree(40); got != maxFieldNumber+1 {
+		t.Errorf("got first free %d after 40, want past max", got)
+	}
+}
+
+func TestNumbererLargeRanges(t *testing.T) {
+	// The map based numberer would take a map entry per excluded number
+	n := newNumberer(1, maxFieldNumber)
+	n.exclude(1000, 100_000_000)
+	for i := 1; i < 1000; i++ {
+		if got := must(n.number(fmt.Sprintf("f%d", i))); got != int32(i) {
+			t.Fatalf("got %d for field %d", got, i)
+		}
+	}
+	if got := must(n.number("after")); got != 100_000_001 {
+		t.Errorf("got %d, want the first number after the range", got)
+	}
+	n.hint("hinted", 5000)
+	if got := must(n.number("hinted")); got != 100_000_002 {
+		t.Errorf("got %d, want a number outside the range", got)
+	}
+}
+
+func TestNumbererRunsOut(t *testing.T) {
+	n := newNumberer(1, maxFieldNumber)
+	n.exclude(1, maxFieldNumber-1)
+	if got := must(n.number("last")); got != maxFieldNumber {
+		t.Fatalf("got %d, want max", got)
+	}
+	if got, err := n.number("over"); err == nil {
+		t.Errorf("got %d past max, want an error", got)
+	}
+
+	// Enum values go up to the largest int32, without wrapping around
+	n = newNumberer(0, maxEnumNumber)
+	n.exclude(0, maxEnumNumber)
+	if got, err := n.number("over"); err == nil {
+		t.Errorf("got enum value %d past max, want an error", got)
+	}
+}
+
+func TestNumbererSkipsImplementationNumbers(t *testing.T) {
+	n := newFieldNumberer()
+	n.exclude(2, 18999)
+	for _, want := range []int32{1, 20000, 20001} {
+		if got := must(n.number(fmt.Sprintf("f%d", want))); got != want {
+			t.Errorf("got %d, want %d", got, want)
+		}
+	}
+	// A hint in the range isn't taken either
+	n.hint("hinted", 19500)
+	if got := must(n.number("hinted")); got != 20002 {
+		t.Errorf("got %d for a hint of 19500, want 20002", got)
+	}
+
+	// Enum values can use them
+	n = newNumberer(0, maxEnumNumber)
+	n.exclude(0, 18999)
+	if got := must(n.number("v")); got != 19000 {
+		t.Errorf("got enum value %d, want 19000", got)
+	}
+}
@@ -0,0 +1,216 @@
+package merge
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Anchor decides where elements that only the overlay has are placed among
+// the elements from base.
+type Anchor string
+
+const (
+	// AnchorEnd places them after everything from base. This is the default.
+	AnchorEnd Anchor = "end"
+	// AnchorAfter places them right after the element that precedes them in
+	// the overlay, or first if nothing does.
+	AnchorAfter Anchor = "after"
+)
+
+func ParseAnchor(s string) (Anchor, error) {
+	switch a := Anchor(s); a {
+	case AnchorEnd, AnchorAfter:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown anchor %q", s)
+}
+
+// directivePrefix starts a comment line that places an overlay element
+// explicitly, "@merge first" or "@merge after <name>". Directives override
+// the anchor and are dropped from the output.
+const directivePrefix = "@merge "
+
+// directive returns the name of the element the comments ask to be placed
+// after, "" to be placed first, and whether there is a directive at all.
+func directive(c *Comments) (string, bool) {
+	for _, comment := range append(slices.Clone(c.LeadingDetachedComments), c.LeadingComments) {
+		for _, line := range strings.Split(comment, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, directivePrefix) {
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(line, directivePrefix))
+			switch {
+			case len(fields) == 1 && fields[0] == "first":
+				return "", true
+			case len(fields) == 2 && fields[0] == "after":
+				return fields[1], true
+			}
+		}
+	}
+	return "", false
+}
+
+// element is an element of a file or message, keyed by its kind and name so
+// that it can be found in every layer.
+type element struct {
+	key      string
+	name     string
+	position *Position
+	comments *Comments
+}
+
+func (s *merger) fileElements(f *File) []element {
+	out := []element{}
+	for _, e := range f.Enums {
+		out = append(out, element{"enum " + e.Name, e.Name, &e.Position, &e.Comments})
+	}
+	for _, m := range f.Messages {
+		out = append(out, element{"message " + m.Name, m.Name, &m.Position, &m.Comments})
+	}
+	for _, e := range f.Extensions {
+		out = append(out, element{"extend " + s.extendeeKey(e.Extendee), "", &e.Position, &e.Comments})
+	}
+	return out
+}
+
+func (s *merger) messageElements(m *Message) []element {
+	out := []element{}
+	for _, o := range m.Options {
+		out = append(out, element{"option " + o.Name, "", &o.Position, &o.Comments})
+	}
+	for _, nested := range m.Messages {
+		out = append(out, element{"message " + nested.Name, nested.Name, &nested.Position, &nested.Comments})
+	}
+	for _, e := range m.Enums {
+		out = append(out, element{"enum " + e.Name, e.Name, &e.Position, &e.Comments})
+	}
+	for _, f := range m.Fields {
+		out = append(out, element{"field " + f.Name, f.Name, &f.Position, &f.Comments})
+	}
+	for _, o := range m.Oneofs {
+		out = append(out, element{"oneof " + o.Name, o.Name, &o.Position, &o.Comments})
+	}
+	for _, e := range m.Extensions {
+		out = append(out, element{"extend " + s.extendeeKey(e.Extendee), "", &e.Position, &e.Comments})
+	}
+	for _, r := range m.ExtensionRanges {
+		out = append(out, element{fmt.Sprintf("extensions %d", r.Start), "", &r.Position, &r.Comments})
+	}
+	for _, r := range m.ReservedRanges {
+		out = append(out, element{fmt.Sprintf("reserved %d", r.Start), "", &r.Position, &r.Comments})
+	}
+	for _, n := range m.ReservedNames {
+		out = append(out, element{"reserved " + n.Name, "", &n.Position, &n.Comments})
+	}
+	return out
+}
+
+// extendeeKey strips whichever layer's package the extendee is in.
+func (s *merger) extendeeKey(extendee string) string {
+	for _, pkg := range []string{s.basePackage, s.mergePackage, s.MergedPackage} {
+		if key := s.localType(pkg, extendee); key != extendee {
+			return key
+		}
+	}
+	return extendee
+}
+
+// order gives the elements of out positions in the order they should be
+// written. Elements from base keep the base's order, the overlay's own
+// elements are placed by directive or by anchor, and everything else, like
+// the reserved ranges the merge adds, goes last.
+func (s *merger) order(out, base, merge []element) {
+	// Repeated options have the same key in every layer
+	for _, elements := range [][]element{out, base, merge} {
+		seen := map[string]int{}
+		for i, e := range elements {
+			if n := seen[e.key]; n > 0 {
+				elements[i].key = fmt.Sprintf("%s#%d", e.key, n)
+			}
+			seen[e.key]++
+		}
+	}
+
+	byPosition := func(a, b element) int {
+		return a.position.compare(*b.position)
+	}
+	slices.SortStableFunc(base, byPosition)
+	slices.SortStableFunc(merge, byPosition)
+
+	outMap := map[string]element{}
+	for _, e := range out {
+		outMap[e.key] = e
+	}
+
+	ordered := []element{}
+	placed := map[string]bool{}
+	for _, e := range base {
+		if o, ok := outMap[e.key]; ok && !placed[e.key] {
+			ordered = append(ordered, o)
+			placed[e.key] = true
+		}
+	}
+
+	// insertAfter places e after the element with the key after, "" for the
+	// start. Elements placed after the same element keep the overlay's order.
+	last := map[string]string{}
+	insertAfter := func(after string, e element) {
+		i := -1
+		target := after
+		if l, ok := last[after]; ok {
+			target = l
+		}
+		if target != "" {
+			i = slices.IndexFunc(ordered, func(o element) bool { return o.key == target })
+		}
+		ordered = slices.Insert(ordered, i+1, e)
+		last[after] = e.key
+	}
+
+	for i, e := range merge {
+		o, ok := outMap[e.key]
+		if !ok || placed[e.key] {
+			continue
+		}
+		placed[e.key] = true
+
+		if name, ok := directive(e.comments); ok {
+			if name == "" {
+				insertAfter("", o)
+				continue
+			}
+			j := slices.IndexFunc(ordered, func(o element) bool { return o.name == name })
+			if j >= 0 {
+				insertAfter(ordered[j].key, o)
+				continue
+			}
+		}
+
+		if s.Anchor == AnchorAfter {
+			previous := ""
+			for j := i - 1; j >= 0; j-- {
+				if placed[merge[j].key] {
+					previous = merge[j].key
+					break
+				}
+			}
+			insertAfter(previous, o)
+			continue
+		}
+
+		ordered = append(ordered, o)
+	}
+
+	for _, e := range out {
+		if !placed[e.key] {
+			ordered = append(ordered, e)
+			placed[e.key] = true
+		}
+	}
+
+	for i, e := range ordered {
+		*e.position = Position{Line: int32(i + 1)}
+	}
+}
@@ -0,0 +1,270 @@
+package merge
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Placement decides which file a type is written to when base and the
+// overlay have it in different files.
+type Placement string
+
+const (
+	// PlaceOverlay writes it where the overlay has it. This is the default.
+	PlaceOverlay Placement = "overlay"
+	// PlaceBase writes it where base has it.
+	PlaceBase Placement = "base"
+)
+
+func ParsePlacement(s string) (Placement, error) {
+	switch p := Placement(s); p {
+	case PlaceOverlay, PlaceBase:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown placement %q", s)
+}
+
+// Regroup prepares a merge of whole packages. The files of each layer are
+// keyed by the output file they are merged into, and their top-level types
+// are matched by fully qualified name across all of them, so a type the
+// overlay moved to another file is still the same type. Each type is moved
+// to the file Places or the Placement picks, in every layer, so that the
+// files can then be merged one by one. The previous output's types go along
+// and keep their numbers.
+//
+// The returned layers have a file for every output that had the file or got
+// a type, nil otherwise. Files that only had types that moved away are left
+// out. Imports of moved types are fixed up with FixImports
+// after merging.
+func (s *MergeSpec) Regroup(base, merge, merged map[string]*File) (map[string]*File, map[string]*File, map[string]*File) {
+	layers := []map[string]*File{base, merge, merged}
+
+	// keys are the names of the top-level elements of f in the output
+	keys := func(layer int, f *File) []string {
+		rewrite := func(name string) string { return name }
+		if layer != int(LayerMerged) {
+			m := s.newMerger(f.Package.Name, f.Package.Name)
+			rewrite = m.rewritePackage
+		}
+		prefix := ""
+		if f.Package.Name != "" {
+			prefix = f.Package.Name + "."
+		}
+		out := []string{}
+		for _, e := range f.Enums {
+			out = append(out, rewrite(prefix+e.Name))
+		}
+		for _, m := range f.Messages {
+			out = append(out, rewrite(prefix+m.Name))
+		}
+		for _, e := range f.Extensions {
+			out = append(out, "extend "+rewrite(strings.TrimPrefix(e.Extendee, ".")))
+		}
+		return out
+	}
+
+	// where is the file of each key in each layer
+	where := [3]map[string]string{}
+	for layer, files := range layers {
+		where[layer] = map[string]string{}
+		for _, name := range sortedNames(files) {
+			for _, key := range keys(layer, files[name]) {
+				if _, ok := where[layer][key]; !ok {
+					where[layer][key] = name
+				}
+			}
+		}
+	}
+
+	first, second := LayerOverlay, LayerBase
+	if s.Placement == PlaceBase {
+		first, second = LayerBase, LayerOverlay
+	}
+	place := func(key string) string {
+		if name, ok := s.Places[key]; ok {
+			return name
+		}
+		for _, layer := range []Layer{first, second, LayerMerged} {
+			if name, ok := where[layer][key]; ok {
+				return name
+			}
+		}
+		return ""
+	}
+
+	out := [3]map[string]*File{}
+	for layer, files := range layers {
+		out[layer] = map[string]*File{}
+		for _, name := range sortedNames(files) {
+			f := files[name]
+			if v, ok := out[layer][name]; ok {
+				// A type placed here came first, the file itself wins
+				v.Syntax, v.Package, v.Options = f.Syntax, f.Package, f.Options
+				v.Dependencies = appendDependencies(f.Dependencies, v.Dependencies)
+			} else {
+				out[layer][name] = &File{Syntax: f.Syntax, Package: f.Package, Options: f.Options, Dependencies: f.Dependencies}
+			}
+
+			fileKeys := keys(layer, f)
+			i := 0
+			target := func() *File {
+				to := place(fileKeys[i])
+				i++
+				v, ok := out[layer][to]
+				if !ok {
+					v = &File{Syntax: f.Syntax, Package: f.Package}
+					out[layer][to] = v
+				}
+				if to != name {
+					// The moved type may need the imports of its file
+					v.Dependencies = appendDependencies(v.Dependencies, f.Dependencies)
+				}
+				return v
+			}
+			for _, e := range f.Enums {
+				v := target()
+				v.Enums = append(v.Enums, e)
+			}
+			for _, m := range f.Messages {
+				v := target()
+				v.Messages = append(v.Messages, m)
+			}
+			for _, e := range f.Extensions {
+				v := target()
+				v.Extensions = append(v.Extensions, e)
+			}
+		}
+	}
+
+	// A file whose types all moved away would be left with only its package
+	// and imports, it's dropped instead
+	dropped := map[string]bool{}
+	for layer, files := range layers {
+		for name, f := range files {
+			if declares(f) && !declares(out[layer][name]) {
+				delete(out[layer], name)
+				dropped[name] = true
+			}
+		}
+	}
+	// and so are imports of it, if no layer has the file anymore.
+	// FixImports adds the files its types moved to
+	for name := range dropped {
+		if out[LayerBase][name] != nil || out[LayerOverlay][name] != nil || out[LayerMerged][name] != nil {
+			delete(dropped, name)
+		}
+	}
+	for _, files := range out {
+		for _, f := range files {
+			m := s.newMerger(f.Package.Name, f.Package.Name)
+			f.Dependencies = slices.DeleteFunc(slices.Clone(f.Dependencies), func(d *Dependency) bool {
+				return dropped[m.rewriteImport(d.Name)]
+			})
+		}
+	}
+
+	return out[LayerBase], out[LayerOverlay], out[LayerMerged]
+}
+
+// declares reports whether f declares any types or extensions.
+func declares(f *File) bool {
+	return len(f.Enums) > 0 || len(f.Messages) > 0 || len(f.Extensions) > 0
+}
+
+func sortedNames(files map[string]*File) []string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// appendDependencies adds the dependencies of b that a doesn't have.
+func appendDependencies(a, b []*Dependency) []*Dependency {
+	out := slices.Clone(a)
+	for _, d := range b {
+		if !slices.ContainsFunc(out, func(o *Dependency) bool { return o.Name == d.Name }) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// FixImports makes the merged files, keyed by name, import exactly the files
+// among them that define the types they use. Imports of other files are left
+// alone, as are imports of files that define extensions, which custom
+// options may need.
+func FixImports(files map[string]*File) {
+	defines := map[string]string{}
+	extends := map[string]bool{}
+	for name, f := range files {
+		for _, e := range f.Enums {
+			defines[scopedName(f.Package.Name, e.Name)] = name
+		}
+		for _, m := range f.Messages {
+			defines[scopedName(f.Package.Name, m.Name)] = name
+		}
+		extends[name] = len(f.Extensions) > 0 || slices.ContainsFunc(f.Messages, func(m *Message) bool { return len(m.Extensions) > 0 })
+	}
+
+	// file returns the file that defines t or one of its parents
+	file := func(t string) (string, bool) {
+		parts := strings.Split(strings.TrimPrefix(t, "."), ".")
+		for i := len(parts); i > 0; i-- {
+			if name, ok := defines[strings.Join(parts[:i], ".")]; ok {
+				return name, true
+			}
+		}
+		return "", false
+	}
+
+	for _, name := range sortedNames(files) {
+		f := files[name]
+		needed := map[string]bool{}
+		use := func(t string) {
+			if other, ok := file(t); ok && other != name {
+				needed[other] = true
+			}
+		}
+		var walk func(m *Message)
+		useExtensions := func(extensions []*Extension) {
+			for _, e := range extensions {
+				use(e.Extendee)
+				for _, field := range e.Fields {
+					use(field.Type)
+				}
+			}
+		}
+		walk = func(m *Message) {
+			for _, field := range allFields(m) {
+				use(field.Type)
+			}
+			useExtensions(m.Extensions)
+			for _, nested := range m.Messages {
+				walk(nested)
+			}
+		}
+		for _, m := range f.Messages {
+			walk(m)
+		}
+		useExtensions(f.Extensions)
+
+		deps := []*Dependency{}
+		for _, d := range f.Dependencies {
+			_, inTree := files[d.Name]
+			if d.Name == name || (inTree && !needed[d.Name] && !extends[d.Name]) {
+				continue
+			}
+			delete(needed, d.Name)
+			deps = append(deps, d)
+		}
+		for _, other := range sortedNames(files) {
+			if needed[other] {
+				deps = append(deps, &Dependency{Name: other})
+			}
+		}
+		f.Dependencies = deps
+	}
+}
@@ -0,0 +1,99 @@
+package merge
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRegroupFollowsMovedTypes(t *testing.T) {
+	prefixes, err := PrefixMapping("base", "merge", "merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged", Mappings: []*Mapping{prefixes}}
+
+	file := func(pkg string, deps []string, messages ...*Message) *File {
+		f := &File{Syntax: &Syntax{Name: "proto3"}, Package: &Package{Name: pkg}, Messages: messages}
+		for _, d := range deps {
+			f.Dependencies = append(f.Dependencies, &Dependency{Name: d})
+		}
+		return f
+	}
+	moved := func(fields ...*Field) *Message { return &Message{Name: "Moved", Fields: fields} }
+
+	base := map[string]*File{
+		"merged/a.proto": file("base", nil, moved(&Field{Name: "x", Type: "int32", Number: 1})),
+		"merged/c.proto": file("base", []string{"base/a.proto"}, &Message{
+			Name:   "User",
+			Fields: []*Field{{Name: "m", Type: ".base.Moved", Number: 1}},
+		}),
+	}
+	overlay := map[string]*File{
+		"merged/b.proto": file("merge", nil, moved(&Field{Name: "x", Type: "int32", Number: 1}, &Field{Name: "y", Type: "int32", Number: 2})),
+	}
+	merged := map[string]*File{
+		"merged/a.proto": file("merged", nil, moved(&Field{Name: "x", Type: "int32", Number: 7})),
+	}
+
+	for _, test := range []struct {
+		placement Placement
+		want      string
+	}{
+		{PlaceOverlay, "merged/b.proto"},
+		{PlaceBase, "merged/a.proto"},
+	} {
+		spec.Placement = test.placement
+		bases, overlays, mergeds := spec.Regroup(base, overlay, merged)
+		if got := mergeds[test.want]; got == nil || len(got.Messages) != 1 {
+			t.Fatalf("%s: the previous output's Moved isn't in %s", test.placement, test.want)
+		}
+		// The file Moved left had nothing else, it isn't kept as a shell
+		for layer, files := range []map[string]*File{bases, overlays, mergeds} {
+			for name, f := range files {
+				if !declares(f) {
+					t.Errorf("%s: %s is left without declarations in layer %d", test.placement, name, layer)
+				}
+			}
+		}
+		if _, ok := bases["merged/a.proto"]; ok != (test.want == "merged/a.proto") {
+			t.Errorf("%s: got base a.proto %v, want it only where Moved is placed", test.placement, ok)
+		}
+
+		outs := map[string]*File{}
+		for _, name := range []string{"merged/a.proto", "merged/b.proto", "merged/c.proto"} {
+			previous := mergeds[name]
+			if previous == nil {
+				previous = &File{}
+			}
+			var out *File
+			switch {
+			case bases[name] == nil && overlays[name] == nil:
+				// Its types moved to other files
+				continue
+			case overlays[name] == nil:
+				out, _, err = spec.PassThrough(bases[name], OriginBase, previous)
+			case bases[name] == nil:
+				out, _, err = spec.PassThrough(overlays[name], OriginOverlay, previous)
+			default:
+				out, _, err = spec.MergeFile(bases[name], overlays[name], previous)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			outs[name] = out
+		}
+		FixImports(outs)
+
+		m := outs[test.want].Messages[0]
+		if m.Name != "Moved" || len(m.Fields) != 2 || m.Fields[0].Number != 7 {
+			t.Errorf("%s: got %s with %d fields, want Moved with both and x = 7", test.placement, m.Name, len(m.Fields))
+		}
+		deps := []string{}
+		for _, d := range outs["merged/c.proto"].Dependencies {
+			deps = append(deps, d.Name)
+		}
+		if !slices.Equal(deps, []string{test.want}) {
+			t.Errorf("%s: c.proto imports %v, want %s", test.placement, deps, test.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package merge
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Layer is one of the three trees a file can be in.
+type Layer int
+
+const (
+	LayerBase Layer = iota
+	LayerOverlay
+	LayerMerged
+)
+
+// Mapping pairs files of base and the overlay with the output file they are
+// merged into. Each side is a path pattern, "*" matches within a path
+// segment and "**" matches any number of them. The text the wildcards match
+// is carried over to the other sides in order, so all sides need the same
+// wildcards. An empty side matches nothing.
+type Mapping struct {
+	Base    string
+	Overlay string
+	Merged  string
+
+	patterns [3]*regexp.Regexp
+	// literals are the sides split around their wildcards
+	literals [3][]string
+}
+
+// ParseMapping parses a mapping written "base:overlay=>merged", e.g.
+// "vendor/api/**:overlay/api/**=>gen/api/**", or
+// "example/base/foo.proto:example/merge/foo_ext.proto=>example/merged/foo.proto"
+// for a file that the overlay renamed.
+func ParseMapping(s string) (*Mapping, error) {
+	from, merged, ok := strings.Cut(s, "=>")
+	if !ok {
+		return nil, fmt.Errorf("mapping %q has no =>", s)
+	}
+	base, overlay, ok := strings.Cut(from, ":")
+	if !ok {
+		return nil, fmt.Errorf("mapping %q has no base:overlay", s)
+	}
+	return NewMapping(base, overlay, merged)
+}
+
+// PrefixMapping maps everything under the base and overlay directories to
+// the same path under the merged one.
+func PrefixMapping(base, overlay, merged string) (*Mapping, error) {
+	dir := func(prefix string) string {
+		if prefix == "" {
+			return ""
+		}
+		return strings.TrimSuffix(prefix, "/") + "/**"
+	}
+	return NewMapping(dir(base), dir(overlay), dir(merged))
+}
+
+func NewMapping(base, overlay, merged string) (*Mapping, error) {
+	m := &Mapping{Base: base, Overlay: overlay, Merged: merged}
+	wildcards := -1
+	for i, side := range []string{base, overlay, merged} {
+		if side == "" {
+			continue
+		}
+		literals, expr := splitPattern(side)
+		if wildcards >= 0 && len(literals)-1 != wildcards {
+			return nil, fmt.Errorf("mapping %s:%s=>%s has different wildcards on each side", base, overlay, merged)
+		}
+		wildcards = len(literals) - 1
+		m.literals[i] = literals
+		m.patterns[i] = regexp.MustCompile("^" + expr + "$")
+	}
+	if m.patterns[LayerMerged] == nil {
+		return nil, fmt.Errorf("mapping %s:%s=>%s has no merged side", base, overlay, merged)
+	}
+	return m, nil
+}
+
+// splitPattern splits a pattern around its wildcards and returns it as a
+// regular expression that captures them.
+func splitPattern(pattern string) ([]string, string) {
+	literals := []string{}
+	expr := ""
+	rest := pattern
+	for {
+		i := strings.Index(rest, "*")
+		if i < 0 {
+			break
+		}
+		literals = append(literals, rest[:i])
+		expr += regexp.QuoteMeta(rest[:i])
+		if strings.HasPrefix(rest[i:], "**") {
+			expr += "(.*)"
+			rest = rest[i+2:]
+		} else {
+			expr += "([^/]*)"
+			rest = rest[i+1:]
+		}
+	}
+	literals = append(literals, rest)
+	expr += regexp.QuoteMeta(rest)
+	return literals, expr
+}
+
+// Match returns the layer name is in and what its wildcards matched, the
+// key that pairs it with the files of the other layers. When the sides
+// nest, like "a/**" and "a/b/**", name is in the layer whose side has the
+// longest prefix before its first wildcard.
+func (m *Mapping) Match(name string) (Layer, string, bool) {
+	var best Layer
+	key, ok := "", false
+	for _, layer := range []Layer{LayerBase, LayerOverlay, LayerMerged} {
+		pattern := m.patterns[layer]
+		if pattern == nil {
+			continue
+		}
+		if ok && len(m.literals[layer][0]) <= len(m.literals[best][0]) {
+			continue
+		}
+		if match := pattern.FindStringSubmatch(name); match != nil {
+			best, key, ok = layer, strings.Join(match[1:], "\x00"), true
+		}
+	}
+	return best, key, ok
+}
+
+// Name returns the file of layer with the key.
+func (m *Mapping) Name(layer Layer, key string) string {
+	literals := m.literals[layer]
+	parts := strings.Split(key, "\x00")
+	out := literals[0]
+	for i, literal := range literals[1:] {
+		if i < len(parts) {
+			out += parts[i]
+		}
+		out += literal
+	}
+	return out
+}
+
+// Output returns the merged file name is mapped to, if it's a base or
+// overlay file of the mapping.
+func (m *Mapping) Output(name string) (string, bool) {
+	layer, key, ok := m.Match(name)
+	if !ok || layer == LayerMerged {
+		return "", false
+	}
+	return m.Name(LayerMerged, key), true
+}
+
+// PackageRule rewrites the package From, and the packages under it, to To.
+// Packages are matched by segment, "acme.api" matches "acme.api.v1" but not
+// "acme.apis".
+type PackageRule struct {
+	From string
+	To   string
+}
+
+// ParsePackageRule parses a rule written "from=>to".
+func ParsePackageRule(s string) (PackageRule, error) {
+	from, to, ok := strings.Cut(s, "=>")
+	if !ok || from == "" {
+		return PackageRule{}, fmt.Errorf("package rule %q isn't from=>to", s)
+	}
+	return PackageRule{From: from, To: to}, nil
+}
+
+// rewrite returns name, a package or a name in one, under To.
+func (r PackageRule) rewrite(name string) (string, bool) {
+	if name != r.From && !strings.HasPrefix(name, r.From+".") {
+		return "", false
+	}
+	return r.To + strings.TrimPrefix(name, r.From), true
+}
+
+// rewriteDir returns name, a file path, under the directory of To if it's
+// under the directory of From.
+func (r PackageRule) rewriteDir(name string) (string, bool) {
+	from := strings.ReplaceAll(r.From, ".", "/") + "/"
+	if !strings.HasPrefix(name, from) {
+		return "", false
+	}
+	return strings.ReplaceAll(r.To, ".", "/") + "/" + strings.TrimPrefix(name, from), true
+}
@@ -0,0 +1,57 @@
+package merge
+
+import "testing"
+
+func TestMapping(t *testing.T) {
+	prefixes, err := PrefixMapping("example/base", "example/merge", "example/merged/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendored, err := ParseMapping("vendor/api/*/**:overlay/api/*/**=>gen/api/*/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := ParseMapping("base/foo.proto:overlay/foo_ext.proto=>out/foo.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := PrefixMapping("a", "a/b", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		mapping *Mapping
+		name    string
+		layer   Layer
+		output  string
+		ok      bool
+	}{
+		{prefixes, "example/base/a/test.proto", LayerBase, "example/merged/a/test.proto", true},
+		{prefixes, "example/merge/test.proto", LayerOverlay, "example/merged/test.proto", true},
+		{prefixes, "example/merged/test.proto", LayerMerged, "example/merged/test.proto", true},
+		{prefixes, "example/basement/test.proto", 0, "", false},
+		{renamed, "overlay/foo_ext.proto", LayerOverlay, "out/foo.proto", true},
+		{renamed, "overlay/foo.proto", 0, "", false},
+		{nested, "a/b/test.proto", LayerOverlay, "out/test.proto", true},
+		{nested, "a/c/test.proto", LayerBase, "out/c/test.proto", true},
+	} {
+		layer, key, ok := tt.mapping.Match(tt.name)
+		if ok != tt.ok || layer != tt.layer {
+			t.Errorf("Match(%q) = %v, %v, want %v, %v", tt.name, layer, ok, tt.layer, tt.ok)
+			continue
+		}
+		if ok {
+			if got := tt.mapping.Name(LayerMerged, key); got != tt.output {
+				t.Errorf("%q maps to %q, want %q", tt.name, got, tt.output)
+			}
+		}
+	}
+
+	if _, err := ParseMapping("vendor/**:overlay/**=>gen/x.proto"); err == nil {
+		t.Error("got no error for a mapping with different wildcards on each side")
+	}
+	if got, _ := vendored.Output("overlay/api/v1/x/y.proto"); got != "gen/api/v1/x/y.proto" {
+		t.Errorf("overlay/api/v1/x/y.proto maps to %q, want gen/api/v1/x/y.proto", got)
+	}
+}
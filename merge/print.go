@@ -3,7 +3,8 @@ package merge
 import (
 	"fmt"
 	"io"
-	"log"
+	"math"
+	"slices"
 	"strings"
 )
 
@@ -66,18 +67,72 @@ func Serialize(f *File) string {
 		writeTrailingComment(buf, dependency.TrailingComments)
 	}
 
+	decls := []declaration{}
 	for _, enum := range f.Enums {
-		writeEnum(buf, enum)
+		enum := enum
+		decls = append(decls, declaration{Position: enum.Position, write: func() { writeEnum(buf, enum) }})
 	}
-
 	for _, message := range f.Messages {
-		writeMessage(buf, message)
+		message := message
+		decls = append(decls, declaration{Position: message.Position, write: func() { writeMessage(buf, message) }})
+	}
+	for _, extension := range f.Extensions {
+		extension := extension
+		decls = append(decls, declaration{Position: extension.Position, write: func() { writeExtension(buf, extension) }})
 	}
+	writeDeclarations(buf, decls, maxFieldNumber)
 
 	return innerBuf.String()
 }
 
-func writeOptions(buf *indentWriter, options []*FileOption) {
+// declaration is an element of a file or message, they are written in the
+// order of their positions.
+type declaration struct {
+	Position
+	write func()
+	// reserved is a *ReservedRange or *ReservedName, reserved elements of the
+	// same kind that end up next to each other share a statement
+	reserved commented
+}
+
+// writeDeclarations sorts decls by position, decls without positions keep the
+// order they are given in.
+func writeDeclarations(buf *indentWriter, decls []declaration, max int32) {
+	slices.SortStableFunc(decls, func(a, b declaration) int {
+		return a.Position.compare(b.Position)
+	})
+
+	for i := 0; i < len(decls); i++ {
+		switch decls[i].reserved.(type) {
+		case *ReservedRange:
+			ranges := []*ReservedRange{}
+			for ; i < len(decls); i++ {
+				r, ok := decls[i].reserved.(*ReservedRange)
+				if !ok {
+					break
+				}
+				ranges = append(ranges, r)
+			}
+			i--
+			writeReservedRanges(buf, ranges, max)
+		case *ReservedName:
+			names := []*ReservedName{}
+			for ; i < len(decls); i++ {
+				n, ok := decls[i].reserved.(*ReservedName)
+				if !ok {
+					break
+				}
+				names = append(names, n)
+			}
+			i--
+			writeReservedNames(buf, names)
+		default:
+			decls[i].write()
+		}
+	}
+}
+
+func writeOptions(buf *indentWriter, options []*Option) {
 	for _, option := range options {
 		writeComments(buf, option.LeadingDetachedComments)
 		writeComment(buf, option.LeadingComments)
@@ -86,6 +141,19 @@ func writeOptions(buf *indentWriter, options []*FileOption) {
 	}
 }
 
+// inlineOptions formats options the way they are written after a field or
+// enum value, e.g. " [deprecated = true]".
+func inlineOptions(options []*Option) string {
+	if len(options) == 0 {
+		return ""
+	}
+	parts := []string{}
+	for _, option := range options {
+		parts = append(parts, fmt.Sprintf("%s = %s", option.Name, option.Value))
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
+}
+
 func writeEnum(buf *indentWriter, e *Enum) {
 	writeComments(buf, e.LeadingDetachedComments)
 	writeComment(buf, e.LeadingComments)
@@ -93,26 +161,17 @@ func writeEnum(buf *indentWriter, e *Enum) {
 	buf.Indent()
 	writeTrailingComment(buf, e.TrailingComments)
 
+	writeOptions(buf, e.Options)
+
 	for _, value := range e.Values {
 		writeComments(buf, value.LeadingDetachedComments)
 		writeComment(buf, value.LeadingComments)
-		buf.WriteString(fmt.Sprintf("%s = %d;\n", value.Name, value.Number))
+		buf.WriteString(fmt.Sprintf("%s = %d%s;\n", value.Name, value.Number, inlineOptions(value.Options)))
 		writeTrailingComment(buf, value.TrailingComments)
 	}
 
-	for _, range_ := range e.ReservedRanges {
-		writeComments(buf, range_.LeadingDetachedComments)
-		writeComment(buf, range_.LeadingComments)
-		buf.WriteString(fmt.Sprintf("reserved %d to %d;\n", range_.Start, range_.End))
-		writeTrailingComment(buf, range_.TrailingComments)
-	}
-
-	for _, name := range e.ReservedNames {
-		writeComments(buf, name.LeadingDetachedComments)
-		writeComment(buf, name.LeadingComments)
-		buf.WriteString(fmt.Sprintf("reserved \"%s\";\n", name.Name))
-		writeTrailingComment(buf, name.TrailingComments)
-	}
+	writeReservedRanges(buf, e.ReservedRanges, maxEnumNumber)
+	writeReservedNames(buf, e.ReservedNames)
 
 	buf.Outdent()
 	buf.WriteString("}\n\n")
@@ -125,52 +184,131 @@ func writeMessage(buf *indentWriter, m *Message) {
 	buf.Indent()
 	writeTrailingComment(buf, m.TrailingComments)
 
+	decls := []declaration{}
+	for _, option := range m.Options {
+		option := option
+		decls = append(decls, declaration{Position: option.Position, write: func() { writeOptions(buf, []*Option{option}) }})
+	}
 	for _, nested := range m.Messages {
-		writeMessage(buf, nested)
+		nested := nested
+		decls = append(decls, declaration{Position: nested.Position, write: func() { writeMessage(buf, nested) }})
 	}
-
 	for _, nested := range m.Enums {
-		writeEnum(buf, nested)
+		nested := nested
+		decls = append(decls, declaration{Position: nested.Position, write: func() { writeEnum(buf, nested) }})
 	}
-
 	for _, field := range m.Fields {
-		writeField(buf, field)
+		field := field
+		decls = append(decls, declaration{Position: field.Position, write: func() { writeField(buf, field) }})
 	}
-
 	for _, oneof := range m.Oneofs {
-		writeOneof(buf, oneof)
+		oneof := oneof
+		decls = append(decls, declaration{Position: oneof.Position, write: func() { writeOneof(buf, oneof) }})
+	}
+	for _, extension := range m.Extensions {
+		extension := extension
+		decls = append(decls, declaration{Position: extension.Position, write: func() { writeExtension(buf, extension) }})
+	}
+	for _, range_ := range m.ExtensionRanges {
+		range_ := range_
+		decls = append(decls, declaration{Position: range_.Position, write: func() { writeExtensionRange(buf, range_) }})
 	}
-
 	for _, range_ := range m.ReservedRanges {
-		log.Println(range_)
-		writeComments(buf, range_.LeadingDetachedComments)
-		writeComment(buf, range_.LeadingComments)
-		buf.WriteString(fmt.Sprintf("reserved %d to %d;\n", range_.Start, range_.End))
-		writeTrailingComment(buf, range_.TrailingComments)
+		decls = append(decls, declaration{Position: range_.Position, reserved: range_})
 	}
-
 	for _, name := range m.ReservedNames {
-		writeComments(buf, name.LeadingDetachedComments)
-		writeComment(buf, name.LeadingComments)
-		buf.WriteString(fmt.Sprintf("reserved \"%s\";\n", name.Name))
-		writeTrailingComment(buf, name.TrailingComments)
+		decls = append(decls, declaration{Position: name.Position, reserved: name})
 	}
+	writeDeclarations(buf, decls, maxFieldNumber)
 
 	buf.Outdent()
 	buf.WriteString("}\n\n")
 }
 
+const (
+	// maxFieldNumber and maxEnumNumber are written as max in the ranges of
+	// messages and enums
+	maxFieldNumber = 536870911
+	maxEnumNumber  = math.MaxInt32
+)
+
+// formatRange formats an inclusive range of numbers, max is the number
+// written as max.
+func formatRange(start, end, max int32) string {
+	switch {
+	case start == end:
+		return fmt.Sprintf("%d", start)
+	case end == max:
+		return fmt.Sprintf("%d to max", start)
+	}
+	return fmt.Sprintf("%d to %d", start, end)
+}
+
+// writeReserved writes elements as reserved statements. Elements without
+// comments share a statement, a leading comment starts a new one and a
+// trailing comment ends it, so the comments stay on the right elements.
+func writeReserved[T commented](buf *indentWriter, elements []T, format func(T) string) {
+	statement := []T{}
+	flush := func() {
+		if len(statement) == 0 {
+			return
+		}
+		first, last := statement[0].comments(), statement[len(statement)-1].comments()
+		parts := []string{}
+		for _, e := range statement {
+			parts = append(parts, format(e))
+		}
+		writeComments(buf, first.LeadingDetachedComments)
+		writeComment(buf, first.LeadingComments)
+		buf.WriteString(fmt.Sprintf("reserved %s;\n", strings.Join(parts, ", ")))
+		writeTrailingComment(buf, last.TrailingComments)
+		statement = statement[:0]
+	}
+
+	for _, e := range elements {
+		c := e.comments()
+		if c.LeadingComments != "" || len(c.LeadingDetachedComments) > 0 {
+			flush()
+		}
+		statement = append(statement, e)
+		if c.TrailingComments != "" {
+			flush()
+		}
+	}
+	flush()
+}
+
+func writeReservedRanges(buf *indentWriter, ranges []*ReservedRange, max int32) {
+	writeReserved(buf, ranges, func(r *ReservedRange) string {
+		return formatRange(r.Start, r.End, max)
+	})
+}
+
+func writeReservedNames(buf *indentWriter, names []*ReservedName) {
+	writeReserved(buf, names, func(n *ReservedName) string {
+		return fmt.Sprintf("\"%s\"", n.Name)
+	})
+}
+
 func writeField(buf *indentWriter, f *Field) {
 	writeComments(buf, f.LeadingDetachedComments)
 	writeComment(buf, f.LeadingComments)
 	if f.Label == "" {
-		buf.WriteString(fmt.Sprintf("%s %s = %d;\n", f.Type, f.Name, f.Number))
+		buf.WriteString(fmt.Sprintf("%s %s = %d;\n", fieldType(f), f.Name, f.Number))
 	} else {
-		buf.WriteString(fmt.Sprintf("%s %s %s = %d;\n", f.Label, f.Type, f.Name, f.Number))
+		buf.WriteString(fmt.Sprintf("%s %s %s = %d;\n", f.Label, fieldType(f), f.Name, f.Number))
 	}
 	writeTrailingComment(buf, f.TrailingComments)
 }
 
+// fieldType is the type of f as it is written, map<K, V> for a map field.
+func fieldType(f *Field) string {
+	if f.Key != "" {
+		return fmt.Sprintf("map<%s, %s>", f.Key, f.Type)
+	}
+	return f.Type
+}
+
 func writeOneof(buf *indentWriter, o *Oneof) {
 	writeComments(buf, o.LeadingDetachedComments)
 	writeComment(buf, o.LeadingComments)
@@ -178,6 +316,8 @@ func writeOneof(buf *indentWriter, o *Oneof) {
 	buf.Indent()
 	writeTrailingComment(buf, o.TrailingComments)
 
+	writeOptions(buf, o.Options)
+
 	for _, field := range o.Fields {
 		writeField(buf, field)
 	}
@@ -186,6 +326,28 @@ func writeOneof(buf *indentWriter, o *Oneof) {
 	buf.WriteString("}\n\n")
 }
 
+func writeExtension(buf *indentWriter, e *Extension) {
+	writeComments(buf, e.LeadingDetachedComments)
+	writeComment(buf, e.LeadingComments)
+	buf.WriteString(fmt.Sprintf("extend %s {\n", e.Extendee))
+	buf.Indent()
+	writeTrailingComment(buf, e.TrailingComments)
+
+	for _, field := range e.Fields {
+		writeField(buf, field)
+	}
+
+	buf.Outdent()
+	buf.WriteString("}\n\n")
+}
+
+func writeExtensionRange(buf *indentWriter, r *ExtensionRange) {
+	writeComments(buf, r.LeadingDetachedComments)
+	writeComment(buf, r.LeadingComments)
+	buf.WriteString(fmt.Sprintf("extensions %s%s;\n", formatRange(r.Start, r.End, maxFieldNumber), inlineOptions(r.Options)))
+	writeTrailingComment(buf, r.TrailingComments)
+}
+
 func writeComments(buf *indentWriter, comments []string) {
 	for _, comment := range comments {
 		writeComment(buf, comment)
@@ -198,7 +360,9 @@ func writeComment(buf *indentWriter, comment string) {
 		return
 	}
 	lines := strings.Split(comment, "\n")
-	if len(lines) > 0 {
+	// Comments from line comments end in a newline, but block comments
+	// don't and their last line must not be dropped
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
 		lines = lines[:len(lines)-1]
 	}
 	for _, line := range lines {
@@ -0,0 +1,133 @@
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Origin is the layer an element of the merged output came from.
+type Origin string
+
+const (
+	OriginBase    Origin = "base"
+	OriginOverlay Origin = "overlay"
+	OriginBoth    Origin = "both"
+)
+
+// Numbering says whether a number was carried over from the previous output
+// or handed out by this merge.
+type Numbering string
+
+const (
+	NumberReused    Numbering = "reused"
+	NumberAllocated Numbering = "allocated"
+	// NumberAliased is the number of another value of an allow_alias enum
+	NumberAliased Numbering = "aliased"
+)
+
+type Kind string
+
+const (
+	KindOption    Kind = "option"
+	KindEnum      Kind = "enum"
+	KindEnumValue Kind = "enum_value"
+	KindMessage   Kind = "message"
+	KindField     Kind = "field"
+	KindExtension Kind = "extension"
+	// KindExtensionRange entries have the range in Reason
+	KindExtensionRange Kind = "extension_range"
+	KindReserved       Kind = "reserved"
+)
+
+// Report describes how a single output file was put together.
+type Report struct {
+	File    string         `json:"file"`
+	Entries []*ReportEntry `json:"entries"`
+	// Diagnostics are the ones at or below the spec's LogLevel
+	Diagnostics []*Diagnostic `json:"diagnostics,omitempty"`
+}
+
+type ReportEntry struct {
+	Kind Kind `json:"kind"`
+	// Path is the dotted name of the element relative to the file's package.
+	Path        string `json:"path"`
+	Origin      Origin `json:"origin,omitempty"`
+	Type        string `json:"type,omitempty"`
+	TypeChanged bool   `json:"type_changed,omitempty"`
+	BaseType    string `json:"base_type,omitempty"`
+	// OneofChanged is set when a field moved into, out of or between
+	// oneofs. Oneof is empty for plain fields.
+	OneofChanged bool      `json:"oneof_changed,omitempty"`
+	Oneof        string    `json:"oneof,omitempty"`
+	BaseOneof    string    `json:"base_oneof,omitempty"`
+	Number       *int32    `json:"number,omitempty"`
+	Numbering    Numbering `json:"numbering,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+func (r *Report) add(e *ReportEntry) {
+	r.Entries = append(r.Entries, e)
+}
+
+func (r *Report) JSON() ([]byte, error) {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (r *Report) Markdown() string {
+	buf := &strings.Builder{}
+	buf.WriteString(fmt.Sprintf("# Merge report for `%s`\n\n", r.File))
+	buf.WriteString("| Kind | Element | Origin | Type | Number | Notes |\n")
+	buf.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	for _, e := range r.Entries {
+		number := ""
+		if e.Number != nil {
+			number = fmt.Sprintf("%d", *e.Number)
+		}
+
+		notes := []string{}
+		if e.Numbering != "" {
+			notes = append(notes, fmt.Sprintf("number %s", e.Numbering))
+		}
+		if e.TypeChanged {
+			notes = append(notes, fmt.Sprintf("type changed from `%s`", e.BaseType))
+		}
+		if e.OneofChanged {
+			notes = append(notes, fmt.Sprintf("moved from %s to %s", placement(e.BaseOneof), placement(e.Oneof)))
+		}
+		if e.Reason != "" {
+			notes = append(notes, e.Reason)
+		}
+
+		typ := ""
+		if e.Type != "" {
+			typ = fmt.Sprintf("`%s`", e.Type)
+		}
+
+		cells := []string{string(e.Kind), fmt.Sprintf("`%s`", e.Path), string(e.Origin), typ, number, strings.Join(notes, "; ")}
+		for i, c := range cells {
+			cells[i] = tableCell(c)
+		}
+		buf.WriteString(fmt.Sprintf("| %s |\n", strings.Join(cells, " | ")))
+	}
+	return buf.String()
+}
+
+// placement describes where a field is declared for the markdown report.
+func placement(oneof string) string {
+	if oneof == "" {
+		return "a plain field"
+	}
+	return fmt.Sprintf("oneof `%s`", oneof)
+}
+
+// tableCell escapes s for a markdown table cell. A | would end the cell, even
+// in a code span, and a line break the row.
+func tableCell(s string) string {
+	s = strings.ReplaceAll(s, "|", "\\|")
+	return strings.ReplaceAll(s, "\n", " ")
+}
@@ -0,0 +1,58 @@
+package merge
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testReport() *Report {
+	return &Report{
+		File: "merged/test.proto",
+		Entries: []*ReportEntry{
+			{Kind: KindField, Path: "M.a", Origin: OriginBoth, Type: "string", TypeChanged: true, BaseType: "int32", Number: ptr(int32(1)), Numbering: NumberReused},
+			{Kind: KindField, Path: "M.b", Origin: OriginOverlay, Type: "int32", Oneof: "o", OneofChanged: true, Number: ptr(int32(2)), Numbering: NumberAllocated},
+			{Kind: KindOption, Path: "(opt)", Origin: OriginOverlay, Reason: "value [type.googleapis.com/a.B] { x: \"a|b\" }\nset by the overlay"},
+		},
+		Diagnostics: []*Diagnostic{{Level: LevelWarn, Path: "M.a", Message: "type changed from int32 to string"}},
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	r := testReport()
+	data, err := r.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Report{}
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatalf("the report isn't valid JSON: %v\n%s", err, data)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("the report changed through JSON:\n%s", data)
+	}
+
+	// Unset fields are left out
+	entries := struct {
+		Entries []map[string]any `json:"entries"`
+	}{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if fields := entries.Entries[2]; len(fields) != 4 {
+		t.Errorf("got option entry %v, want only kind, path, origin and reason", fields)
+	}
+}
+
+func TestReportMarkdown(t *testing.T) {
+	want := "# Merge report for `merged/test.proto`\n" +
+		"\n" +
+		"| Kind | Element | Origin | Type | Number | Notes |\n" +
+		"| --- | --- | --- | --- | --- | --- |\n" +
+		"| field | `M.a` | both | `string` | 1 | number reused; type changed from `int32` |\n" +
+		"| field | `M.b` | overlay | `int32` | 2 | number allocated; moved from a plain field to oneof `o` |\n" +
+		"| option | `(opt)` | overlay |  |  | value [type.googleapis.com/a.B] { x: \"a\\|b\" } set by the overlay |\n"
+	if got := testReport().Markdown(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -1,225 +1,382 @@
 package merge
 
 import (
+	"cmp"
 	"fmt"
-	"log"
+	"math"
 	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/maxmzkr/protoc_merge/internal/protoparse"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
-func ParseFile(f *descriptorpb.FileDescriptorProto) *File {
-	out := &File{}
-	locations := f.GetSourceCodeInfo().GetLocation()
-	for len(locations) > 0 {
-		location := locations[0]
+// ParseSource reads the named .proto files from importPaths without protoc.
+// Imports that can't be found are allowed, types from them are kept as
+// written, and options are kept as the literals found in the source.
+func ParseSource(importPaths []string, names ...string) ([]*File, error) {
+	p := &protoparse.Parser{
+		ImportPaths:     importPaths,
+		AllowUnresolved: true,
+	}
+	descriptors, err := p.Parse(names...)
+	if err != nil {
+		return nil, err
+	}
 
-		if len(location.GetPath()) == 0 {
-			locations = locations[1:]
-			continue
+	out := []*File{}
+	for _, d := range descriptors {
+		out = append(out, ParseFile(d))
+	}
+	return out, nil
+}
+
+// ParseFiles is ParseFile for a set of files, like the ones in a
+// CodeGeneratorRequest. protoc passes custom options as unknown fields, they
+// are named using the extensions defined in any of the files.
+func ParseFiles(files []*descriptorpb.FileDescriptorProto) ([]*File, error) {
+	registry, err := newRegistry(files)
+	if err != nil {
+		return nil, err
+	}
+	unmarshal := proto.UnmarshalOptions{Resolver: dynamicpb.NewTypes(registry)}
+
+	out := []*File{}
+	for _, f := range files {
+		data, err := proto.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		resolved := &descriptorpb.FileDescriptorProto{}
+		if err := unmarshal.Unmarshal(data, resolved); err != nil {
+			return nil, err
 		}
+		out = append(out, ParseFile(resolved))
+	}
+	return out, nil
+}
 
-		switch location.GetPath()[0] {
-		case 2:
-			var filePackage *Package
-			locations, filePackage = parsePackage(locations, f.GetPackage())
-			out.Package = filePackage
-		case 3:
-			var dependency *Dependency
-			locations, dependency = parseDependency(locations, f.GetDependency()[location.GetPath()[1]])
-			out.Dependencies = append(out.Dependencies, dependency)
-		case 4:
-			var message *Message
-			locations, message = parseMessage(locations, f.GetMessageType()[location.GetPath()[1]])
-			out.Messages = append(out.Messages, message)
-		case 5:
-			var enum *Enum
-			locations, enum = parseEnum(locations, f.GetEnumType()[location.GetPath()[1]])
-			out.Enums = append(out.Enums, enum)
-		case 6:
-			// I don't think we'll handle service
-			locations = consumeLocation(locations)
-		case 7:
-			// I don't think we'll handle extensions
-			locations = consumeLocation(locations)
-		case 8:
-			var fileOption *FileOption
-			locations, fileOption = parseFileOption(locations, f.GetOptions())
-			out.Options = append(out.Options, fileOption)
-		case 12:
-			var syntax *Syntax
-			locations, syntax = parseSyntax(locations, f.GetSyntax())
-			out.Syntax = syntax
+// newRegistry builds the descriptors of files. Files compiled into the binary,
+// like descriptor.proto, are used as is so that their extensions can be set
+// on the generated options messages.
+func newRegistry(files []*descriptorpb.FileDescriptorProto) (*protoregistry.Files, error) {
+	byName := map[string]*descriptorpb.FileDescriptorProto{}
+	for _, f := range files {
+		byName[f.GetName()] = f
+	}
+
+	registry := &protoregistry.Files{}
+	var register func(name string) error
+	register = func(name string) error {
+		if _, err := registry.FindFileByPath(name); err == nil {
+			return nil
+		}
+		if d, err := protoregistry.GlobalFiles.FindFileByPath(name); err == nil {
+			return registry.RegisterFile(d)
 		}
+		f, ok := byName[name]
+		if !ok {
+			// Unresolved imports only lose the options they define
+			return nil
+		}
+		// Guard against import cycles
+		delete(byName, name)
+		for _, dep := range f.GetDependency() {
+			if err := register(dep); err != nil {
+				return err
+			}
+		}
+		d, err := protodesc.FileOptions{AllowUnresolvable: true}.New(f, registry)
+		if err != nil {
+			return err
+		}
+		return registry.RegisterFile(d)
 	}
+
+	for _, f := range files {
+		if err := register(f.GetName()); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+// ParseFile builds the model from a descriptor. Comments are looked up by the
+// path of every element, so missing source info only loses the comments.
+func ParseFile(f *descriptorpb.FileDescriptorProto) *File {
+	index := newLocationIndex(f.GetSourceCodeInfo())
+
+	syntax := f.GetSyntax()
+	if syntax == "" {
+		// protoc leaves the syntax of proto2 files unset
+		syntax = "proto2"
+	}
+
+	out := &File{
+		Syntax: &Syntax{
+			Comments: index.comments(12),
+			Name:     syntax,
+		},
+		Package: &Package{
+			Comments: index.comments(2),
+			Name:     f.GetPackage(),
+		},
+		Options: parseOptions(index, []int32{8}, f.GetOptions()),
+	}
+
+	for i, d := range f.GetDependency() {
+		out.Dependencies = append(out.Dependencies, &Dependency{
+			Comments: index.comments(3, int32(i)),
+			Name:     d,
+		})
+	}
+	for i, m := range f.GetMessageType() {
+		if m.GetOptions().GetMapEntry() {
+			continue
+		}
+		out.Messages = append(out.Messages, parseMessage(index, []int32{4, int32(i)}, m, syntax == "proto2"))
+	}
+	for i, e := range f.GetEnumType() {
+		out.Enums = append(out.Enums, parseEnum(index, []int32{5, int32(i)}, e))
+	}
+	out.Extensions = parseExtensions(index, []int32{7}, f.GetExtension(), syntax == "proto2")
 	return out
 }
 
-func parsePackage(locations []*descriptorpb.SourceCodeInfo_Location, p string) ([]*descriptorpb.SourceCodeInfo_Location, *Package) {
-	filePackage := &Package{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    p,
+// locationIndex finds the source locations of a path. Some paths, like the
+// ones of reserved statements, have a location per statement.
+type locationIndex map[string][]*descriptorpb.SourceCodeInfo_Location
+
+func newLocationIndex(info *descriptorpb.SourceCodeInfo) locationIndex {
+	index := locationIndex{}
+	for _, location := range info.GetLocation() {
+		key := pathKey(location.GetPath())
+		index[key] = append(index[key], location)
 	}
-	return locations[1:], filePackage
+	return index
 }
 
-func parseDependency(locations []*descriptorpb.SourceCodeInfo_Location, d string) ([]*descriptorpb.SourceCodeInfo_Location, *Dependency) {
-	dependency := &Dependency{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    d,
+func pathKey(path []int32) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = strconv.Itoa(int(p))
 	}
-	return locations[1:], dependency
+	return strings.Join(parts, ".")
+}
+
+// childPath returns a copy of path extended by elems.
+func childPath(path []int32, elems ...int32) []int32 {
+	return append(slices.Clone(path), elems...)
+}
+
+func (index locationIndex) all(path ...int32) []*descriptorpb.SourceCodeInfo_Location {
+	return index[pathKey(path)]
 }
 
-func parseMessage(locations []*descriptorpb.SourceCodeInfo_Location, m *descriptorpb.DescriptorProto) ([]*descriptorpb.SourceCodeInfo_Location, *Message) {
+func (index locationIndex) get(path ...int32) *descriptorpb.SourceCodeInfo_Location {
+	locations := index.all(path...)
+	if len(locations) == 0 {
+		return nil
+	}
+	return locations[0]
+}
+
+func (index locationIndex) comments(path ...int32) Comments {
+	return parseComments(index.get(path...))
+}
+
+func (index locationIndex) position(path ...int32) Position {
+	return parsePosition(index.get(path...))
+}
+
+func parseMessage(index locationIndex, path []int32, m *descriptorpb.DescriptorProto, proto2 bool) *Message {
 	out := &Message{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    m.GetName(),
-	}
-	startLocation := locations[0]
-	locations = locations[1:]
-	nested := len(startLocation.GetPath())
-	for len(locations) > 0 &&
-		len(locations[0].GetPath()) >= nested &&
-		locations[0].GetPath()[nested-2] == startLocation.GetPath()[nested-2] &&
-		locations[0].GetPath()[nested-1] == startLocation.GetPath()[nested-1] {
-
-		location := locations[0]
-		switch location.GetPath()[nested] {
-		case 1:
-			// already parsed
-			locations = locations[1:]
-		case 2:
-			var field *Field
-			locations, field = parseField(locations, m.GetField()[location.GetPath()[nested+1]])
-			out.Fields = append(out.Fields, field)
-		case 3:
-			var message *Message
-			locations, message = parseMessage(locations, m.GetNestedType()[location.GetPath()[nested+1]])
-			out.Messages = append(out.Messages, message)
-		case 4:
-			var enum *Enum
-			locations, enum = parseEnum(locations, m.GetEnumType()[location.GetPath()[nested+1]])
-			out.Enums = append(out.Enums, enum)
-		case 5:
-			// I don't think we'll handle message extensions
-			locations = consumeLocation(locations)
-		case 6:
-			// I don't think we'll handle message extensions
-			locations = consumeLocation(locations)
-		case 7:
-			// TODO handle message options
-			locations = consumeLocation(locations)
-		case 8:
-			var oneof *Oneof
-			locations, oneof = parseOneof(locations, m, m.GetOneofDecl()[location.GetPath()[nested+1]])
-			out.Oneofs = append(out.Oneofs, oneof)
-		case 9:
-			var reservedRanges []*ReservedRange
-			locations, reservedRanges = parseReservedRanges(locations, m.GetReservedRange())
-			out.ReservedRanges = append(out.ReservedRanges, reservedRanges...)
-		case 10:
-			var reservedNames []*ReservedName
-			locations, reservedNames = parseReservedNames(locations, m.GetReservedName())
-			out.ReservedNames = append(out.ReservedNames, reservedNames...)
-		default:
-			locations = locations[1:]
+		Comments: index.comments(path...),
+		Position: index.position(path...),
+		Name:     m.GetName(),
+		Options:  parseOptions(index, childPath(path, 7), m.GetOptions()),
+	}
+
+	// proto3 optional fields are in a oneof of their own, which isn't
+	// written in the source. Real oneofs can't have optional fields.
+	synthetic := map[int32]bool{}
+	for _, f := range m.GetField() {
+		if f.OneofIndex != nil && f.GetProto3Optional() {
+			synthetic[f.GetOneofIndex()] = true
+		}
+	}
+
+	for i, f := range m.GetField() {
+		if f.OneofIndex != nil && !synthetic[f.GetOneofIndex()] {
+			continue
+		}
+		field := parseField(index, childPath(path, 2, int32(i)), f, proto2)
+		if entry := mapEntry(m, f); entry != nil {
+			// Map fields are written as map<K, V>, their entry messages
+			// are generated
+			field.Label = ""
+			field.Key = descriptorType(entry.GetField()[0])
+			field.Type = descriptorType(entry.GetField()[1])
+		}
+		out.Fields = append(out.Fields, field)
+	}
+	for i, o := range m.GetOneofDecl() {
+		if synthetic[int32(i)] {
+			continue
 		}
+		out.Oneofs = append(out.Oneofs, parseOneof(index, path, m, int32(i), o, proto2))
 	}
-	return locations, out
+	for i, nested := range m.GetNestedType() {
+		if nested.GetOptions().GetMapEntry() {
+			continue
+		}
+		out.Messages = append(out.Messages, parseMessage(index, childPath(path, 3, int32(i)), nested, proto2))
+	}
+	for i, e := range m.GetEnumType() {
+		out.Enums = append(out.Enums, parseEnum(index, childPath(path, 4, int32(i)), e))
+	}
+
+	out.Extensions = parseExtensions(index, childPath(path, 6), m.GetExtension(), proto2)
+	out.ExtensionRanges = parseExtensionRanges(index, childPath(path, 5), m.GetExtensionRange())
+
+	out.ReservedRanges = parseReservedRanges(index, childPath(path, 9), m.GetReservedRange(), true)
+	out.ReservedNames = parseReservedNames(index, childPath(path, 10), m.GetReservedName())
+
+	return out
 }
 
-func parseField(locations []*descriptorpb.SourceCodeInfo_Location, f *descriptorpb.FieldDescriptorProto) ([]*descriptorpb.SourceCodeInfo_Location, *Field) {
-	var fieldType string
-	if f.GetTypeName() != "" {
-		fieldType = f.GetTypeName()
-	} else {
-		fieldType = strings.ToLower(strings.Split(f.GetType().String(), "_")[1])
+// parseExtensions groups the extension fields under path back into their
+// extend blocks. Like reserved statements, every extend block has a location
+// at path and its fields are the ones within its span. Without source info,
+// consecutive fields with the same extendee are grouped together.
+func parseExtensions(index locationIndex, path []int32, fields []*descriptorpb.FieldDescriptorProto, proto2 bool) []*Extension {
+	out := []*Extension{}
+	var last *Extension
+	var lastStatement *descriptorpb.SourceCodeInfo_Location
+	for i, f := range fields {
+		fieldPath := childPath(path, int32(i))
+
+		var statement *descriptorpb.SourceCodeInfo_Location
+		if location := index.get(fieldPath...); location != nil {
+			for _, s := range index.all(path...) {
+				if spanContains(s.GetSpan(), location.GetSpan()) {
+					statement = s
+					break
+				}
+			}
+		}
+
+		if last == nil || last.Extendee != f.GetExtendee() || statement != lastStatement {
+			last = &Extension{
+				Comments: parseComments(statement),
+				Position: parsePosition(statement),
+				Extendee: f.GetExtendee(),
+			}
+			out = append(out, last)
+			lastStatement = statement
+		}
+		last.Fields = append(last.Fields, parseField(index, fieldPath, f, proto2))
 	}
+	return out
+}
 
+// parseField builds a field. proto2 fields outside of oneofs are written
+// with their label, optional ones too.
+func parseField(index locationIndex, path []int32, f *descriptorpb.FieldDescriptorProto, proto2 bool) *Field {
 	var label string
-	if f.GetProto3Optional() {
+	switch {
+	case f.GetProto3Optional():
 		label = "optional"
-	} else if f.GetLabel() != descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL {
+	case f.GetLabel() != descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL:
 		label = strings.ToLower(strings.Split(f.GetLabel().String(), "_")[1])
+	case proto2 && f.OneofIndex == nil:
+		label = "optional"
 	}
 
-	out := &Field{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    f.GetName(),
-		Number:                  f.GetNumber(),
-		Label:                   label,
-		Type:                    fieldType,
+	return &Field{
+		Comments: index.comments(path...),
+		Position: index.position(path...),
+		Name:     f.GetName(),
+		Number:   f.GetNumber(),
+		Label:    label,
+		Type:     descriptorType(f),
 	}
+}
 
-	locations = consumeLocation(locations)
+// descriptorType is the type name of f, or the scalar type it is declared
+// with.
+func descriptorType(f *descriptorpb.FieldDescriptorProto) string {
+	if f.GetTypeName() != "" {
+		return f.GetTypeName()
+	}
+	return strings.ToLower(strings.Split(f.GetType().String(), "_")[1])
+}
 
-	return locations, out
+// mapEntry returns the map entry message of f if f is a map field of m.
+func mapEntry(m *descriptorpb.DescriptorProto, f *descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	if f.GetLabel() != descriptorpb.FieldDescriptorProto_LABEL_REPEATED {
+		return nil
+	}
+	name := f.GetTypeName()
+	for _, nested := range m.GetNestedType() {
+		if !nested.GetOptions().GetMapEntry() || len(nested.GetField()) != 2 {
+			continue
+		}
+		if name == nested.GetName() || strings.HasSuffix(name, "."+nested.GetName()) {
+			return nested
+		}
+	}
+	return nil
 }
 
-func parseEnum(locations []*descriptorpb.SourceCodeInfo_Location, e *descriptorpb.EnumDescriptorProto) ([]*descriptorpb.SourceCodeInfo_Location, *Enum) {
-	out := &Enum{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    e.GetName(),
-	}
-	startLocation := locations[0]
-	locations = locations[1:]
-	nested := len(startLocation.GetPath())
-	for len(locations) > 0 &&
-		len(locations[0].GetPath()) >= nested &&
-		locations[0].GetPath()[nested-2] == startLocation.GetPath()[nested-2] &&
-		locations[0].GetPath()[nested-1] == startLocation.GetPath()[nested-1] {
-
-		location := locations[0]
-		switch location.GetPath()[nested] {
-		case 1:
-			// already parsed
-			locations = locations[1:]
-		case 2:
-			var enumValue *EnumValue
-			locations, enumValue = parseEnumValue(locations, e.GetValue()[location.GetPath()[nested+1]])
-			out.Values = append(out.Values, enumValue)
-		case 3:
-			// TODO handle enum options
-			locations = consumeLocation(locations)
-		case 4:
-			var reservedRanges []*ReservedRange
-			locations, reservedRanges = parseReservedRanges(locations, e.GetReservedRange())
-			out.ReservedRanges = append(out.ReservedRanges, reservedRanges...)
-		case 5:
-			var reservedNames []*ReservedName
-			locations, reservedNames = parseReservedNames(locations, e.GetReservedName())
-			out.ReservedNames = append(out.ReservedNames, reservedNames...)
-		default:
-			locations = locations[1:]
+func parseOneof(index locationIndex, messagePath []int32, m *descriptorpb.DescriptorProto, i int32, o *descriptorpb.OneofDescriptorProto, proto2 bool) *Oneof {
+	path := childPath(messagePath, 8, i)
+	out := &Oneof{
+		Comments: index.comments(path...),
+		Position: index.position(path...),
+		Name:     o.GetName(),
+		Options:  parseOptions(index, childPath(path, 2), o.GetOptions()),
+	}
+
+	for j, f := range m.GetField() {
+		if f.OneofIndex == nil || f.GetOneofIndex() != i {
+			continue
 		}
+		out.Fields = append(out.Fields, parseField(index, childPath(messagePath, 2, int32(j)), f, proto2))
 	}
-	return locations, out
+
+	return out
 }
 
-func parseEnumValue(locations []*descriptorpb.SourceCodeInfo_Location, e *descriptorpb.EnumValueDescriptorProto) ([]*descriptorpb.SourceCodeInfo_Location, *EnumValue) {
-	out := &EnumValue{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    e.GetName(),
-		Number:                  e.GetNumber(),
+func parseEnum(index locationIndex, path []int32, e *descriptorpb.EnumDescriptorProto) *Enum {
+	out := &Enum{
+		Comments: index.comments(path...),
+		Position: index.position(path...),
+		Name:     e.GetName(),
+		Options:  parseOptions(index, childPath(path, 3), e.GetOptions()),
 	}
 
-	locations = consumeLocation(locations)
+	for i, v := range e.GetValue() {
+		valuePath := childPath(path, 2, int32(i))
+		out.Values = append(out.Values, &EnumValue{
+			Comments: index.comments(valuePath...),
+			Position: index.position(valuePath...),
+			Name:     v.GetName(),
+			Number:   v.GetNumber(),
+			Options:  parseOptions(index, childPath(valuePath, 3), v.GetOptions()),
+		})
+	}
 
-	return locations, out
+	out.ReservedRanges = parseReservedRanges(index, childPath(path, 4), e.GetReservedRange(), false)
+	out.ReservedNames = parseReservedNames(index, childPath(path, 5), e.GetReservedName())
+
+	return out
 }
 
 type reservedRange interface {
@@ -227,184 +384,375 @@ type reservedRange interface {
 	GetEnd() int32
 }
 
-func parseReservedRanges[T reservedRange](locations []*descriptorpb.SourceCodeInfo_Location, r []T) ([]*descriptorpb.SourceCodeInfo_Location, []*ReservedRange) {
+// parseReservedRanges parses reserved ranges, exclusive is set for message
+// ranges, whose descriptors hold exclusive ends. Enum ranges are inclusive.
+func parseReservedRanges[T reservedRange](index locationIndex, path []int32, ranges []T, exclusive bool) []*ReservedRange {
 	out := []*ReservedRange{}
+	for i, r := range ranges {
+		end := r.GetEnd()
+		if exclusive {
+			end--
+		}
+		out = append(out, &ReservedRange{
+			Comments: index.comments(childPath(path, int32(i))...),
+			Position: index.position(childPath(path, int32(i))...),
+			Start:    r.GetStart(),
+			End:      end,
+		})
+	}
+	attachStatementComments(index, path, out)
+	return out
+}
 
-	startLocation := locations[0]
-	locations = locations[1:]
-	nested := len(startLocation.GetPath())
-
-	// reservedRanges have a three path element as the first element. So we have to use the span to determine the end
-	endLine := startLocation.GetSpan()[0]
-	endColumn := startLocation.GetSpan()[2]
-	if len(startLocation.GetSpan()) > 3 {
-		endLine = endColumn
-		endColumn = startLocation.GetSpan()[3]
+func parseExtensionRanges(index locationIndex, path []int32, ranges []*descriptorpb.DescriptorProto_ExtensionRange) []*ExtensionRange {
+	out := []*ExtensionRange{}
+	for i, r := range ranges {
+		rangePath := childPath(path, int32(i))
+		out = append(out, &ExtensionRange{
+			Comments: index.comments(rangePath...),
+			Position: index.position(rangePath...),
+			Start:    r.GetStart(),
+			End:      r.GetEnd() - 1,
+			// Only the first range of a statement has locations for the
+			// options, the others have copies of them
+			Options: parseOptions(index, childPath(rangePath, 3), r.GetOptions()),
+		})
 	}
+	attachStatementComments(index, path, out)
+	return out
+}
 
-	for len(locations) > 0 &&
-		(locations[0].GetSpan()[0] < endLine ||
-			(locations[0].GetSpan()[0] == endLine &&
-				locations[0].GetSpan()[1] < endColumn)) {
-		var reservedRange *ReservedRange
-		locations, reservedRange = parseReservedRange(locations, r[locations[0].GetPath()[nested]])
-		out = append(out, reservedRange)
+func parseReservedNames(index locationIndex, path []int32, names []string) []*ReservedName {
+	out := []*ReservedName{}
+	for i, name := range names {
+		out = append(out, &ReservedName{
+			Comments: index.comments(childPath(path, int32(i))...),
+			Position: index.position(childPath(path, int32(i))...),
+			Name:     name,
+		})
 	}
+	attachStatementComments(index, path, out)
+	return out
+}
 
-	out[0].LeadingDetachedComments = startLocation.GetLeadingDetachedComments()
-	out[0].LeadingComments = startLocation.GetLeadingComments()
-	out[len(out)-1].TrailingComments = startLocation.GetTrailingComments()
+// commented is implemented by every element of the model.
+type commented interface {
+	comments() *Comments
+}
 
-	return locations, out
+func (c *Comments) comments() *Comments {
+	return c
 }
 
-func parseReservedRange(locations []*descriptorpb.SourceCodeInfo_Location, r reservedRange) ([]*descriptorpb.SourceCodeInfo_Location, *ReservedRange) {
-	out := &ReservedRange{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Start:                   r.GetStart(),
-		// While it is inclusive in the protobufs, it's exclusive in the reservedRange
-		End: r.GetEnd() - 1,
-	}
+// attachStatementComments moves the comments of statements that declare
+// several elements, like reserved statements, onto the elements. The leading
+// comments go to the first element of the statement and the trailing ones to
+// the last. protoc records one location per statement under path, so the
+// elements of a statement are the ones within its span.
+func attachStatementComments[T commented](index locationIndex, path []int32, elements []T) {
+	for _, statement := range index.all(path...) {
+		first, last := -1, -1
+		for i := range elements {
+			location := index.get(childPath(path, int32(i))...)
+			if location == nil || !spanContains(statement.GetSpan(), location.GetSpan()) {
+				continue
+			}
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+		if first < 0 {
+			continue
+		}
 
-	locations = consumeLocation(locations)
+		c := elements[first].comments()
+		c.LeadingDetachedComments = statement.GetLeadingDetachedComments()
+		c.LeadingComments = statement.GetLeadingComments()
+		elements[last].comments().TrailingComments = statement.GetTrailingComments()
+	}
+}
 
-	return locations, out
+// spanContains reports whether the span inner starts within the span outer.
+// Spans are [start line, start column, end line, end column], with the end
+// line left out if it is the start line.
+func spanContains(outer, inner []int32) bool {
+	if len(outer) < 3 || len(inner) < 2 {
+		return false
+	}
+	endLine, endColumn := outer[0], outer[2]
+	if len(outer) > 3 {
+		endLine, endColumn = outer[2], outer[3]
+	}
+	return comparePosition(outer[0], outer[1], inner[0], inner[1]) <= 0 &&
+		comparePosition(inner[0], inner[1], endLine, endColumn) < 0
 }
 
-func parseReservedNames(locations []*descriptorpb.SourceCodeInfo_Location, r []string) ([]*descriptorpb.SourceCodeInfo_Location, []*ReservedName) {
-	out := []*ReservedName{}
+func comparePosition(aLine, aColumn, bLine, bColumn int32) int {
+	if aLine != bLine {
+		return cmp.Compare(aLine, bLine)
+	}
+	return cmp.Compare(aColumn, bColumn)
+}
 
-	startLocation := locations[0]
-	locations = locations[1:]
-	nested := len(startLocation.GetPath())
+// optionsMessage is implemented by the options messages in descriptor.proto
+type optionsMessage interface {
+	proto.Message
+	GetUninterpretedOption() []*descriptorpb.UninterpretedOption
+}
 
-	// reservedNames have a three path element as the first element. So we have to use the span to determine the end
-	endLine := startLocation.GetSpan()[0]
-	endColumn := startLocation.GetSpan()[2]
-	if len(startLocation.GetSpan()) > 3 {
-		endLine = endColumn
-		endColumn = startLocation.GetSpan()[3]
+// parseOptions returns the options set in o, in the order they appear in
+// the source. path is the path of o, e.g. [8] for file options.
+func parseOptions(index locationIndex, path []int32, o optionsMessage) []*Option {
+	type positioned struct {
+		option   *Option
+		location *descriptorpb.SourceCodeInfo_Location
+	}
+	options := []positioned{}
+
+	add := func(name, value string, location *descriptorpb.SourceCodeInfo_Location) {
+		options = append(options, positioned{
+			option: &Option{
+				Comments: parseComments(location),
+				Position: parsePosition(location),
+				Name:     name,
+				Value:    value,
+			},
+			location: location,
+		})
 	}
 
-	for len(locations) > 0 &&
-		(locations[0].GetSpan()[0] < endLine ||
-			(locations[0].GetSpan()[0] == endLine &&
-				locations[0].GetSpan()[1] < endColumn)) {
-		var reservedName *ReservedName
-		locations, reservedName = parseReservedName(locations, r[locations[0].GetPath()[nested]])
-		out = append(out, reservedName)
+	o.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Number() == 999 || fd.IsMap() {
+			return true
+		}
+		name := string(fd.Name())
+		if fd.IsExtension() {
+			name = "(" + string(fd.FullName()) + ")"
+		}
+		if !fd.IsList() {
+			add(name, formatValue(fd, v), index.get(childPath(path, int32(fd.Number()))...))
+			return true
+		}
+		// protoc gives every element of a repeated option a location
+		list := v.List()
+		for i := 0; i < list.Len(); i++ {
+			add(name, formatValue(fd, list.Get(i)), index.get(childPath(path, int32(fd.Number()), int32(i))...))
+		}
+		return true
+	})
+
+	// Options protoc couldn't interpret, or any option in files read by
+	// ParseSource
+	for i, uninterpreted := range o.GetUninterpretedOption() {
+		add(uninterpretedName(uninterpreted), uninterpretedValue(uninterpreted), index.get(childPath(path, 999, int32(i))...))
 	}
 
-	out[0].LeadingDetachedComments = startLocation.GetLeadingDetachedComments()
-	out[0].LeadingComments = startLocation.GetLeadingComments()
-	out[len(out)-1].TrailingComments = startLocation.GetTrailingComments()
+	// Options without a location go last
+	slices.SortStableFunc(options, func(a, b positioned) int {
+		switch {
+		case a.location == nil && b.location == nil:
+			return 0
+		case a.location == nil:
+			return 1
+		case b.location == nil:
+			return -1
+		}
+		aSpan, bSpan := a.location.GetSpan(), b.location.GetSpan()
+		return comparePosition(aSpan[0], aSpan[1], bSpan[0], bSpan[1])
+	})
 
-	return locations, out
+	out := []*Option{}
+	for _, o := range options {
+		out = append(out, o.option)
+	}
+	return out
 }
 
-func parseReservedName(locations []*descriptorpb.SourceCodeInfo_Location, r string) ([]*descriptorpb.SourceCodeInfo_Location, *ReservedName) {
-	out := &ReservedName{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    r,
+// formatValue formats a single option value as a .proto literal.
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return quote([]byte(v.String()))
+	case protoreflect.BytesKind:
+		return quote(v.Bytes())
+	case protoreflect.BoolKind:
+		return strconv.FormatBool(v.Bool())
+	case protoreflect.EnumKind:
+		if value := fd.Enum().Values().ByNumber(v.Enum()); value != nil {
+			return string(value.Name())
+		}
+		return strconv.Itoa(int(v.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.FormatInt(v.Int(), 10)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.FormatUint(v.Uint(), 10)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return formatFloat(v.Float())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		buf := &strings.Builder{}
+		buf.WriteString("{\n")
+		writeMessageValue(buf, v.Message(), 1)
+		buf.WriteString("}")
+		return buf.String()
 	}
-
-	return locations[1:], out
+	return ""
 }
 
-func parseFileOption(locations []*descriptorpb.SourceCodeInfo_Location, o *descriptorpb.FileOptions) ([]*descriptorpb.SourceCodeInfo_Location, *FileOption) {
-	out := &FileOption{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-	}
+// writeMessageValue writes the fields of m in the text format, one per line.
+// prototext isn't used because its output isn't stable.
+func writeMessageValue(buf *strings.Builder, m protoreflect.Message, depth int) {
+	fields := []protoreflect.FieldDescriptor{}
+	m.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		fields = append(fields, fd)
+		return true
+	})
+	slices.SortFunc(fields, func(a, b protoreflect.FieldDescriptor) int {
+		return cmp.Compare(a.Number(), b.Number())
+	})
+
+	indent := strings.Repeat("  ", depth)
+	for _, fd := range fields {
+		name := string(fd.Name())
+		if fd.IsExtension() {
+			name = "[" + string(fd.FullName()) + "]"
+		}
+		if fd.IsMap() {
+			continue
+		}
+
+		values := []protoreflect.Value{m.Get(fd)}
+		if fd.IsList() {
+			values = nil
+			list := m.Get(fd).List()
+			for i := 0; i < list.Len(); i++ {
+				values = append(values, list.Get(i))
+			}
+		}
 
-	// The first location is a 1 path element, so we can skip it
-	locations = locations[1:]
-	location := locations[0]
-	fieldNumber := location.GetPath()[len(location.GetPath())-1]
-	switch fieldNumber {
-	case 11:
-		out.Name = "go_package"
-		out.Value = fmt.Sprintf("\"%s\"", o.GetGoPackage())
-	default:
-		log.Println(o.GetUninterpretedOption())
+		for _, v := range values {
+			if fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind {
+				buf.WriteString(fmt.Sprintf("%s%s: %s\n", indent, name, formatValue(fd, v)))
+				continue
+			}
+			buf.WriteString(fmt.Sprintf("%s%s: {\n", indent, name))
+			writeMessageValue(buf, v.Message(), depth+1)
+			buf.WriteString(indent + "}\n")
+		}
 	}
-	return consumeLocation(locations), out
 }
 
-func parseOneof(locations []*descriptorpb.SourceCodeInfo_Location, m *descriptorpb.DescriptorProto, o *descriptorpb.OneofDescriptorProto) ([]*descriptorpb.SourceCodeInfo_Location, *Oneof) {
-	out := &Oneof{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    o.GetName(),
-	}
-
-	startLocation := locations[0]
-	locations = locations[1:]
-	nested := len(startLocation.GetPath())
-	for len(locations) > 0 &&
-		len(locations[0].GetPath()) >= nested &&
-		locations[0].GetPath()[nested-2] == startLocation.GetPath()[nested-2] &&
-		locations[0].GetPath()[nested-1] == startLocation.GetPath()[nested-1] {
-
-		location := locations[0]
-		switch location.GetPath()[nested] {
-		case 1:
-			// already parsed
-			locations = locations[1:]
-		case 2:
-			// TODO handle oneof options
-			locations = consumeLocation(locations)
-		default:
-			locations = locations[1:]
+func uninterpretedName(o *descriptorpb.UninterpretedOption) string {
+	parts := []string{}
+	for _, part := range o.GetName() {
+		if part.GetIsExtension() {
+			parts = append(parts, "("+part.GetNamePart()+")")
+		} else {
+			parts = append(parts, part.GetNamePart())
 		}
 	}
+	return strings.Join(parts, ".")
+}
 
-	// parse the one of fields using the spans as a guide
-	endLine := startLocation.GetSpan()[0]
-	endColumn := startLocation.GetSpan()[2]
-	if len(startLocation.GetSpan()) > 3 {
-		endLine = endColumn
-		endColumn = startLocation.GetSpan()[3]
+// uninterpretedValue formats the value of o as a .proto literal.
+func uninterpretedValue(o *descriptorpb.UninterpretedOption) string {
+	switch {
+	case o.IdentifierValue != nil:
+		return o.GetIdentifierValue()
+	case o.PositiveIntValue != nil:
+		return strconv.FormatUint(o.GetPositiveIntValue(), 10)
+	case o.NegativeIntValue != nil:
+		return strconv.FormatInt(o.GetNegativeIntValue(), 10)
+	case o.DoubleValue != nil:
+		return formatFloat(o.GetDoubleValue())
+	case o.StringValue != nil:
+		return quote(o.GetStringValue())
+	case o.AggregateValue != nil:
+		return dedent("{" + o.GetAggregateValue() + "}")
 	}
+	return ""
+}
 
-	for len(locations) > 0 &&
-		(locations[0].GetSpan()[0] < endLine ||
-			(locations[0].GetSpan()[0] == endLine &&
-				locations[0].GetSpan()[1] < endColumn)) {
-		var field *Field
-		locations, field = parseField(locations, m.GetField()[locations[0].GetPath()[nested-1]])
-		out.Fields = append(out.Fields, field)
+// dedent removes the indentation the lines after the first have in common,
+// so that a literal can be indented again wherever it is written.
+func dedent(s string) string {
+	lines := strings.Split(s, "\n")
+	common := -1
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if common < 0 || indent < common {
+			common = indent
+		}
 	}
-
-	return locations, out
+	for i := 1; i < len(lines); i++ {
+		if len(lines[i]) >= common && common > 0 {
+			lines[i] = lines[i][common:]
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
-func parseSyntax(locations []*descriptorpb.SourceCodeInfo_Location, s string) ([]*descriptorpb.SourceCodeInfo_Location, *Syntax) {
-	out := &Syntax{
-		LeadingDetachedComments: locations[0].GetLeadingDetachedComments(),
-		LeadingComments:         locations[0].GetLeadingComments(),
-		TrailingComments:        locations[0].GetTrailingComments(),
-		Name:                    s,
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsNaN(v):
+		return "nan"
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		// Keep it a float literal
+		s += ".0"
 	}
+	return s
+}
 
-	return locations[1:], out
+// quote writes s as a .proto string literal.
+func quote(s []byte) string {
+	buf := &strings.Builder{}
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch c {
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(buf, "\\%03o", c)
+				continue
+			}
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
 }
 
-func consumeLocation(locations []*descriptorpb.SourceCodeInfo_Location) []*descriptorpb.SourceCodeInfo_Location {
-	startLocation := locations[0]
-	nested := len(startLocation.GetPath())
-	for len(locations) > 0 &&
-		len(locations[0].GetPath()) >= nested &&
-		slices.Equal(locations[0].GetPath()[:nested], startLocation.GetPath()[:nested]) &&
-		slices.Equal(locations[0].GetPath()[:nested], startLocation.GetPath()[:nested]) {
+func parsePosition(location *descriptorpb.SourceCodeInfo_Location) Position {
+	span := location.GetSpan()
+	if len(span) < 2 {
+		return Position{}
+	}
+	return Position{Line: span[0] + 1, Column: span[1] + 1}
+}
 
-		locations = locations[1:]
+func parseComments(location *descriptorpb.SourceCodeInfo_Location) Comments {
+	return Comments{
+		LeadingDetachedComments: location.GetLeadingDetachedComments(),
+		LeadingComments:         location.GetLeadingComments(),
+		TrailingComments:        location.GetTrailingComments(),
 	}
-	return locations
 }
@@ -0,0 +1,439 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maxmzkr/protoc_merge/internal/diff"
+	"github.com/maxmzkr/protoc_merge/internal/protoparse"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestParseSourceWithUnresolvedImports(t *testing.T) {
+	// options.proto lives in example/options, which isn't searched
+	files, err := ParseSource([]string{filepath.Join("..", "example", "step1", "base")}, "test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := files[0]
+
+	if len(f.Options) != 2 {
+		t.Fatalf("got %d options, want 2", len(f.Options))
+	}
+	option := f.Options[1]
+	if option.Name != "(options.complex_option)" {
+		t.Errorf("got option %q, want (options.complex_option)", option.Name)
+	}
+	want := `{
+  int32_option: 1,
+  nested_option: {
+    string_option: "string"
+  }
+}`
+	if option.Value != want {
+		t.Errorf("got value %q, want the literal from the source %q", option.Value, want)
+	}
+
+	if got := f.Messages[0].Fields[2].Type; got != ".base.TestEnum" {
+		t.Errorf("got type %q, want .base.TestEnum", got)
+	}
+}
+
+func exampleDescriptor(t *testing.T, dir string) *descriptorpb.FileDescriptorProto {
+	t.Helper()
+
+	path := filepath.Join("..", "example", dir)
+	p := &protoparse.Parser{ImportPaths: []string{path, filepath.Join("..", "example", "options")}}
+	files, err := p.Parse("test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0]
+}
+
+func TestParseFileIgnoresLocationOrder(t *testing.T) {
+	d := exampleDescriptor(t, "step3/merged")
+	want := Serialize(ParseFile(d))
+
+	locations := d.GetSourceCodeInfo().GetLocation()
+	slices.Reverse(locations)
+	if got := Serialize(ParseFile(d)); got != want {
+		t.Errorf("reversing the locations changed the output:\n%s", diff.Unified("want", "got", want, got))
+	}
+}
+
+func TestParseFileWithoutSourceInfo(t *testing.T) {
+	d := exampleDescriptor(t, "step3/merged")
+	d.SourceCodeInfo = nil
+
+	f := ParseFile(d)
+	if got := len(f.Messages[0].Fields); got == 0 {
+		t.Fatal("got no fields")
+	}
+	if got := len(f.Messages[0].ReservedRanges); got == 0 {
+		t.Fatal("got no reserved ranges")
+	}
+	if f.Messages[0].LeadingComments != "" {
+		t.Errorf("got comments %q without source info", f.Messages[0].LeadingComments)
+	}
+}
+
+func TestParseSourceOneofs(t *testing.T) {
+	dir := t.TempDir()
+	src := `syntax = "proto3";
+package oneofs;
+message M {
+  optional int32 a = 1;
+  oneof choice {
+    // options of the oneof
+    option (opts.required) = true;
+    string b = 2;
+    int32 c = 3;
+  }
+  optional string d = 4;
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "oneofs.proto"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseSource([]string{dir}, "oneofs.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := files[0].Messages[0]
+
+	// The oneofs of a and d are synthetic
+	if len(m.Oneofs) != 1 || m.Oneofs[0].Name != "choice" {
+		t.Fatalf("got oneofs %v, want only choice", m.Oneofs)
+	}
+	if len(m.Fields) != 2 || m.Fields[0].Label != "optional" || m.Fields[1].Label != "optional" {
+		t.Errorf("got fields %v, want the optional fields a and d", m.Fields)
+	}
+	options := m.Oneofs[0].Options
+	if len(options) != 1 || options[0].Name != "(opts.required)" || options[0].Value != "true" {
+		t.Fatalf("got oneof options %v, want (opts.required) = true", options)
+	}
+	if options[0].LeadingComments != " options of the oneof\n" {
+		t.Errorf("got comment %q on the oneof option", options[0].LeadingComments)
+	}
+
+	out := Serialize(files[0])
+	if strings.Contains(out, "oneof _") {
+		t.Errorf("a synthetic oneof was written:\n%s", out)
+	}
+	if !strings.Contains(out, "    option (opts.required) = true;\n") {
+		t.Errorf("the oneof option wasn't written:\n%s", out)
+	}
+}
+
+func TestMergeExtensions(t *testing.T) {
+	dir := t.TempDir()
+	src := `syntax = "proto3";
+import "google/protobuf/descriptor.proto";
+package merge;
+
+// More file options
+extend google.protobuf.FileOptions {
+  int32 int_option = 50002;
+}
+
+message Holder {
+  extend google.protobuf.MessageOptions {
+    string holder_option = 50100;
+  }
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "options.proto"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseSource([]string{filepath.Join("..", "example", "options")}, "options.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := files[0]
+	files, err = ParseSource([]string{dir}, "options.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge := files[0]
+
+	if got := merge.Extensions[0].LeadingComments; got != " More file options\n" {
+		t.Errorf("got extend comment %q", got)
+	}
+	if got := len(merge.Messages[0].Extensions); got != 1 {
+		t.Fatalf("got %d nested extend blocks, want 1", got)
+	}
+
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+	out, _ := mustMerge(t, spec, base, merge, &File{})
+	if got := len(out.Extensions); got != 1 {
+		t.Fatalf("got %d extend blocks, want them combined into 1", got)
+	}
+	want := map[string]int32{"string_option": 50000, "complex_option": 50001, "int_option": 50002}
+	for _, f := range out.Extensions[0].Fields {
+		if f.Number != want[f.Name] {
+			t.Errorf("got %s = %d, want %d", f.Name, f.Number, want[f.Name])
+		}
+		delete(want, f.Name)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing extensions %v", want)
+	}
+
+	// The previous output pins the numbers
+	first := Serialize(out)
+	again, _ := mustMerge(t, spec, base, merge, out)
+	if got := Serialize(again); got != first {
+		t.Errorf("merging the output again changed it:\n%s", diff.Unified("first", "again", first, got))
+	}
+
+	// Extension numbers are never renumbered, a clash is an error
+	merge.Extensions[0].Fields[0].Number = 50001
+	_, _, err = spec.MergeFile(base, merge, &File{})
+	if err == nil || !strings.Contains(err.Error(), "extension int_option of .google.protobuf.FileOptions uses the number 50001 of extension complex_option") {
+		t.Errorf("got error %v, want a clash of int_option and complex_option", err)
+	}
+}
+
+func TestParseSourceReservedRanges(t *testing.T) {
+	dir := t.TempDir()
+	src := `syntax = "proto3";
+package reserved;
+enum E {
+  E_UNKNOWN = 0;
+  // Enum ranges are inclusive
+  reserved 2 to 3, 10 to max;
+}
+message M {
+  reserved 4, 6, 10 to 100;
+  // Kept apart
+  reserved 20000;
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "reserved.proto"), []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ParseSource([]string{dir}, "reserved.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ranges := files[0].Enums[0].ReservedRanges
+	if len(ranges) != 2 || ranges[0].End != 3 || ranges[1].End != maxEnumNumber {
+		t.Errorf("got enum ranges %v, want 2 to 3 and 10 to max", ranges)
+	}
+
+	out := Serialize(files[0])
+	for _, want := range []string{
+		"  // Enum ranges are inclusive\n  reserved 2 to 3, 10 to max;\n",
+		"  reserved 4, 6, 10 to 100;\n",
+		"  // Kept apart\n  reserved 20000;\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMergeMapFields(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"base.proto": `syntax = "proto3";
+package base;
+message M {
+  map<string, int32> counts = 1;
+  map<int64, Value> values = 2;
+  message Value {
+    string name = 1;
+  }
+}
+`,
+		"merge.proto": `syntax = "proto3";
+package merge;
+message M {
+  map<string, int32> counts = 1;
+  map<string, Value> values = 2;
+  map<string, string> labels = 3;
+  message Value {
+    string name = 1;
+  }
+}
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ParseSource([]string{dir}, "base.proto", "merge.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, merge := files[0], files[1]
+
+	if got := len(base.Messages[0].Messages); got != 1 {
+		t.Errorf("got %d nested messages, want the map entries left out", got)
+	}
+
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+	out, report := mustMerge(t, spec, base, merge, &File{})
+	got := Serialize(out)
+	for _, want := range []string{
+		"  map<string, int32> counts = 1;\n",
+		"  map<string, .merged.M.Value> values = 2;\n",
+		"  map<string, string> labels = 3;\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("output is missing %q:\n%s", want, got)
+		}
+	}
+
+	changed := map[string]bool{}
+	for _, e := range report.Entries {
+		if e.TypeChanged {
+			changed[e.Path] = true
+		}
+	}
+	if !changed["M.values"] || changed["M.counts"] {
+		t.Errorf("got type changes %v, want only M.values whose key changed", changed)
+	}
+
+	// The output parses back to the same fields
+	if again := Serialize(reparse(t, out)); again != got {
+		t.Errorf("the output changed when parsed again:\n%s", diff.Unified("first", "again", got, again))
+	}
+}
+
+// compile checks that f is a .proto file protoc accepts.
+func compile(t *testing.T, f *File) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "out.proto"), []byte(Serialize(f)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := &protoparse.Parser{ImportPaths: []string{dir}}
+	if _, err := p.Parse("out.proto"); err != nil {
+		t.Errorf("the output doesn't compile: %v\n%s", err, Serialize(f))
+	}
+}
+
+func TestMergeProto2(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"base.proto": `syntax = "proto2";
+package base;
+message M {
+  optional string x = 1;
+  required string y = 2;
+  repeated int32 z = 3;
+  oneof o {
+    string w = 4;
+  }
+}
+`,
+		"merge.proto": `syntax = "proto2";
+package merge;
+message M {
+  optional string x = 1;
+  optional int64 v = 5;
+}
+`,
+		"proto3.proto": `syntax = "proto3";
+package merge;
+message M {
+  string x = 1;
+}
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ParseSource([]string{dir}, "base.proto", "merge.proto", "proto3.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, merge, proto3 := files[0], files[1], files[2]
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+
+	merged, _ := mustMerge(t, spec, base, merge, &File{})
+	passed, _, err := spec.PassThrough(base, OriginBase, &File{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstoned, _, err := spec.Tombstone(passed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		out  *File
+		want []string
+	}{
+		{"merged", merged, []string{"  optional string x = 1;\n", "  required string y = 2;\n", "    string w = ", "  optional int64 v = "}},
+		{"base only", passed, []string{"  optional string x = 1;\n", "  required string y = 2;\n", "  repeated int32 z = 3;\n"}},
+		{"tombstoned", tombstoned, nil},
+	} {
+		got := Serialize(test.out)
+		for _, want := range append([]string{"syntax = \"proto2\";\n"}, test.want...) {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: output is missing %q:\n%s", test.name, want, got)
+			}
+		}
+		compile(t, test.out)
+	}
+
+	if _, _, err := spec.MergeFile(base, proto3, &File{}); err == nil || !strings.Contains(err.Error(), `the overlay's syntax "proto3" is not base's "proto2"`) {
+		t.Errorf("got error %v, want a syntax mismatch", err)
+	}
+}
+
+func TestMergeExtensionRangesEndToEnd(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"base.proto": `syntax = "proto2";
+package base;
+message M {
+  optional int32 a = 1;
+  extensions 100 to 199;
+}
+`,
+		"merge.proto": `syntax = "proto2";
+package merge;
+message M {
+  optional int32 b = 2;
+  extensions 200 to 299;
+}
+`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ParseSource([]string{dir}, "base.proto", "merge.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &MergeSpec{MergePackage: "merge", MergedPackage: "merged"}
+	out, _ := mustMerge(t, spec, files[0], files[1], &File{})
+	if got := Serialize(out); !strings.Contains(got, "  extensions 100 to 299;\n") {
+		t.Errorf("output is missing the combined range:\n%s", got)
+	}
+	compile(t, out)
+
+	// proto3 has no extension ranges, they aren't written even if the
+	// layers have them
+	for _, f := range files {
+		f.Syntax.Name = "proto3"
+		for _, field := range f.Messages[0].Fields {
+			field.Label = ""
+		}
+	}
+	out, _ = mustMerge(t, spec, files[0], files[1], &File{})
+	if got := Serialize(out); strings.Contains(got, "extensions") {
+		t.Errorf("proto3 output has extension ranges:\n%s", got)
+	}
+	compile(t, out)
+}
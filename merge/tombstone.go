@@ -0,0 +1,171 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tombstone returns what is left of merged, the previous output of a file
+// that base and the overlay no longer have. Its types keep their names but
+// lose their fields, which are reserved so that the numbers aren't reused if
+// the types come back. Enums keep their zero value, proto3 needs one.
+func (s *MergeSpec) Tombstone(merged *File) (*File, *Report, error) {
+	m := s.newMerger(merged.Package.Name, merged.Package.Name)
+	m.logf(LevelInfo, LayerMerged, Position{}, "", "removed from base and the overlay, its numbers stay reserved")
+	out := m.tombstoneFile(merged)
+	return out, m.report, errors.Join(m.errs...)
+}
+
+func (s *merger) tombstoneFile(merged *File) *File {
+	out := &File{
+		Syntax:  &Syntax{Comments: s.mergeComments(merged.Syntax.Comments, Comments{}), Name: merged.Syntax.Name},
+		Package: &Package{Comments: s.mergeComments(merged.Package.Comments, Comments{}), Name: merged.Package.Name},
+	}
+	for _, o := range merged.Options {
+		out.Options = append(out.Options, &Option{
+			Comments: s.mergeComments(o.Comments, Comments{}),
+			Name:     o.Name,
+			Value:    o.Value,
+		})
+	}
+	// Imports stay for the file options that need them
+	for _, d := range merged.Dependencies {
+		out.Dependencies = append(out.Dependencies, &Dependency{
+			Comments: s.mergeComments(d.Comments, Comments{}),
+			Name:     d.Name,
+		})
+	}
+
+	for _, e := range merged.Enums {
+		out.Enums = append(out.Enums, s.tombstoneEnum(e.Name, e))
+	}
+	for _, m := range merged.Messages {
+		out.Messages = append(out.Messages, s.tombstoneMessage(m.Name, m))
+	}
+	// Extension numbers belong to the extendee, which may live on. They
+	// are only reported
+	for _, e := range merged.Extensions {
+		for _, f := range e.Fields {
+			s.report.add(&ReportEntry{
+				Kind:   KindReserved,
+				Path:   f.Name,
+				Number: ptr(f.Number),
+				Reason: fmt.Sprintf("extension %s was removed with its file", f.Name),
+			})
+			s.logf(LevelWarn, LayerMerged, f.Position, f.Name, "extension of %s was removed, its number %d can be reused", e.Extendee, f.Number)
+		}
+	}
+
+	s.order(s.fileElements(out), nil, nil)
+
+	return out
+}
+
+func (s *merger) tombstoneMessage(path string, merged *Message) *Message {
+	s.report.add(&ReportEntry{
+		Kind:   KindMessage,
+		Path:   path,
+		Reason: "file was removed",
+	})
+
+	out := &Message{
+		Comments: s.mergeComments(merged.Comments, Comments{}),
+		Name:     merged.Name,
+	}
+
+	// Extensions elsewhere may still use the ranges
+	for _, r := range merged.ExtensionRanges {
+		out.ExtensionRanges = append(out.ExtensionRanges, &ExtensionRange{
+			Comments: s.mergeComments(r.Comments, Comments{}),
+			Start:    r.Start,
+			End:      r.End,
+			Options:  r.Options,
+		})
+	}
+
+	for _, e := range merged.Enums {
+		out.Enums = append(out.Enums, s.tombstoneEnum(scopedName(path, e.Name), e))
+	}
+	for _, m := range merged.Messages {
+		out.Messages = append(out.Messages, s.tombstoneMessage(scopedName(path, m.Name), m))
+	}
+
+	removedRanges := []*ReservedRange{}
+	removedNames := []*ReservedName{}
+	for _, f := range allFields(merged) {
+		removedRanges = append(removedRanges, &ReservedRange{
+			Comments: Comments{
+				LeadingComments: fmt.Sprintf(" Reserved because the field %s was removed\n", f.Name),
+			},
+			Start: f.Number,
+			End:   f.Number,
+		})
+		s.report.add(&ReportEntry{
+			Kind:   KindReserved,
+			Path:   scopedName(path, f.Name),
+			Number: ptr(f.Number),
+			Reason: fmt.Sprintf("field %s was removed with its file", f.Name),
+		})
+		removedNames = append(removedNames, &ReservedName{Name: f.Name})
+	}
+	out.ReservedRanges = s.mergeReservedRanges(nil, nil, merged.ReservedRanges, removedRanges)
+	out.ReservedNames = s.mergeReservedNames(nil, nil, merged.ReservedNames, removedNames)
+
+	s.order(s.messageElements(out), nil, nil)
+
+	return out
+}
+
+func (s *merger) tombstoneEnum(path string, merged *Enum) *Enum {
+	s.report.add(&ReportEntry{
+		Kind:   KindEnum,
+		Path:   path,
+		Reason: "file was removed",
+	})
+
+	out := &Enum{
+		Comments: s.mergeComments(merged.Comments, Comments{}),
+		Name:     merged.Name,
+	}
+
+	removedRanges := []*ReservedRange{}
+	removedNames := []*ReservedName{}
+	for _, v := range merged.Values {
+		if v.Number == 0 && len(out.Values) == 0 {
+			out.Values = append(out.Values, &EnumValue{
+				Comments: s.mergeComments(v.Comments, Comments{}),
+				Name:     v.Name,
+				Number:   0,
+			})
+			s.report.add(&ReportEntry{
+				Kind:      KindEnumValue,
+				Path:      scopedName(path, v.Name),
+				Number:    ptr(v.Number),
+				Numbering: NumberReused,
+			})
+			continue
+		}
+		s.report.add(&ReportEntry{
+			Kind:   KindReserved,
+			Path:   scopedName(path, v.Name),
+			Number: ptr(v.Number),
+			Reason: fmt.Sprintf("enum value %s was removed with its file", v.Name),
+		})
+		removedNames = append(removedNames, &ReservedName{Name: v.Name})
+		// Aliases of the zero value only free their names
+		if v.Number == 0 {
+			continue
+		}
+		removedRanges = append(removedRanges, &ReservedRange{
+			Comments: Comments{
+				LeadingComments: fmt.Sprintf(" Reserved because the field %s was removed\n", v.Name),
+			},
+			Start: v.Number,
+			End:   v.Number,
+		})
+	}
+	out.ReservedRanges = s.mergeReservedRanges(nil, nil, merged.ReservedRanges, removedRanges)
+	out.ReservedNames = s.mergeReservedNames(nil, nil, merged.ReservedNames, removedNames)
+
+	return out
+}